@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ErrRequiredSignatureMissing is returned by SignBatch when a package does not
+// carry a valid signature from any of BatchOptions.RequiredKeys
+var ErrRequiredSignatureMissing = errors.New("package is not signed by a required key")
+
+// BatchOptions configures SignBatch and SignTree
+type BatchOptions struct {
+	// Key is the entity that signs the packages. Its current signing key,
+	// which may be a subkey, must have a decrypted private key.
+	Key *openpgp.Entity
+	// SignatureOptions controls how new signatures are made
+	SignatureOptions *SignatureOptions
+	// Keyring holds the keys that existing signatures are verified against.
+	// If set, a package with a signature from any other key is rejected.
+	// Otherwise, signatures from unknown keys are ignored.
+	Keyring openpgp.EntityList
+	// RequiredKeys, if set, requires each package to already carry a valid
+	// signature from one of the given keys before it is re-signed
+	RequiredKeys openpgp.EntityList
+	// Workers is the number of packages processed concurrently. If not set,
+	// defaults to GOMAXPROCS.
+	Workers int
+}
+
+// BatchStatus is the outcome of signing one package in a batch
+type BatchStatus int
+
+// Batch signing outcomes
+const (
+	// BatchSigned means a new signature was added to the package
+	BatchSigned BatchStatus = iota
+	// BatchSkipped means the package already had a valid signature from the
+	// signing key and was left untouched
+	BatchSkipped
+	// BatchFailed means the package was not signed, see BatchResult.Err
+	BatchFailed
+)
+
+func (s BatchStatus) String() string {
+	switch s {
+	case BatchSigned:
+		return "signed"
+	case BatchSkipped:
+		return "skipped"
+	case BatchFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// BatchResult holds the outcome of signing one package in a batch
+type BatchResult struct {
+	// Path of the package
+	Path string
+	// Status of the package
+	Status BatchStatus
+	// Err is set if Status is BatchFailed
+	Err error
+}
+
+// SignBatch signs each of the given RPM files in place using a pool of
+// workers. Existing signatures are verified first, and packages that already
+// carry a valid signature from the signing key are skipped, so an interrupted
+// batch can be safely restarted. Each package is overwritten in place if its
+// reserved signature space allows it, otherwise it is replaced atomically.
+//
+// Results are returned in the same order as paths. If ctx is cancelled, the
+// packages that have not yet been started fail with the context's error, and
+// that error is also returned.
+func SignBatch(ctx context.Context, paths []string, opts *BatchOptions) ([]BatchResult, error) {
+	if opts == nil || opts.Key == nil {
+		return nil, errors.New("no signing key given")
+	}
+	signer, ok := opts.Key.SigningKey(time.Now())
+	if !ok || signer.PrivateKey == nil {
+		return nil, errors.New("no usable signing key found")
+	} else if signer.PrivateKey.Encrypted {
+		return nil, errors.New("signing key must be decrypted")
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	results := make([]BatchResult, len(paths))
+	indexes := make(chan int)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = opts.signOne(ctx, paths[i], signer.PrivateKey)
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+// SignTree signs every file ending in .rpm under root, as SignBatch does
+func SignTree(ctx context.Context, root string, opts *BatchOptions) ([]BatchResult, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && strings.HasSuffix(d.Name(), ".rpm") {
+			paths = append(paths, path)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return SignBatch(ctx, paths, opts)
+}
+
+func (opts *BatchOptions) signOne(ctx context.Context, path string, key *packet.PrivateKey) BatchResult {
+	result := BatchResult{Path: path, Status: BatchFailed}
+	if result.Err = ctx.Err(); result.Err != nil {
+		return result
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer f.Close()
+	signed, err := opts.checkExisting(f)
+	if err != nil {
+		result.Err = err
+		return result
+	} else if signed {
+		result.Status = BatchSkipped
+		return result
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		result.Err = err
+		return result
+	}
+	if _, err := SignRpmFile(f, path, key, opts.SignatureOptions); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Status = BatchSigned
+	return result
+}
+
+// checkExisting verifies the signatures already in a RPM and returns true if
+// one of them was made by the signing key
+func (opts *BatchOptions) checkExisting(stream io.Reader) (bool, error) {
+	knownKeys := make(openpgp.EntityList, 0, len(opts.Keyring)+len(opts.RequiredKeys)+1)
+	knownKeys = append(knownKeys, opts.Key)
+	knownKeys = append(knownKeys, opts.Keyring...)
+	knownKeys = append(knownKeys, opts.RequiredKeys...)
+	_, sigHeader, err := readSignatureHeader(stream)
+	if err != nil {
+		return false, err
+	}
+	headerDigestValue, headerDigestType := getHashAndType(sigHeader)
+	genHeader, err := readHeader(stream, headerDigestValue, headerDigestType, sigHeader.isSource, false)
+	if err != nil {
+		return false, err
+	}
+	sigs, hashes, err := digestAndVerify(sigHeader, genHeader, stream, knownKeys)
+	if err != nil {
+		return false, err
+	}
+	var signed, required bool
+	for i, sig := range sigs {
+		if err := sig.validate(hashes[i]); err != nil {
+			if errors.As(err, &KeyNotFoundError{}) && opts.Keyring == nil {
+				continue
+			}
+			return false, err
+		}
+		if entityIn(sig.Signer, openpgp.EntityList{opts.Key}) {
+			signed = true
+		}
+		if entityIn(sig.Signer, opts.RequiredKeys) {
+			required = true
+		}
+	}
+	if signed {
+		// already re-signed, which may have replaced the required signature
+		return true, nil
+	} else if len(opts.RequiredKeys) != 0 && !required {
+		return false, ErrRequiredSignatureMissing
+	}
+	return false, nil
+}
+
+func entityIn(entity *openpgp.Entity, keys openpgp.EntityList) bool {
+	if entity == nil {
+		return false
+	}
+	for _, key := range keys {
+		if key == entity || bytes.Equal(key.PrimaryKey.Fingerprint, entity.PrimaryKey.Fingerprint) {
+			return true
+		}
+	}
+	return false
+}
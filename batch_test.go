@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignBatch(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	oldKey := keyring[0]
+	newKey, err := openpgp.NewEntity("new key", "", "", &packet.Config{RSABits: 2048})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for _, name := range []string{"simple-1.0.1-1.i386.rpm", "one-epoch-0.1-1.x86_64.rpm"} {
+		fp := copyTestRpm(t, filepath.Join("testdata", name))
+		require.NoError(t, os.Rename(fp, filepath.Join(dir, name)))
+	}
+	// the old key is required but hasn't signed anything yet
+	opts := &BatchOptions{
+		Key:          newKey,
+		RequiredKeys: openpgp.EntityList{oldKey},
+		Workers:      2,
+	}
+	results, err := SignTree(context.Background(), dir, opts)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		assert.Equal(t, BatchFailed, result.Status)
+		assert.ErrorIs(t, result.Err, ErrRequiredSignatureMissing)
+	}
+	// sign with the old key, then rotate
+	results, err = SignTree(context.Background(), dir, &BatchOptions{Key: oldKey})
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.Equal(t, BatchSigned, result.Status, result.Path)
+	}
+	results, err = SignTree(context.Background(), dir, opts)
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.Equal(t, BatchSigned, result.Status, result.Path)
+	}
+	// running again does nothing
+	results, err = SignTree(context.Background(), dir, opts)
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.Equal(t, BatchSkipped, result.Status, result.Path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = SignBatch(ctx, []string{filepath.Join(dir, "simple-1.0.1-1.i386.rpm")}, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	require.Len(t, results, 1)
+	assert.ErrorIs(t, results[0].Err, context.Canceled)
+
+	// a key is required
+	_, err = SignBatch(context.Background(), nil, nil)
+	assert.Error(t, err)
+	_, err = SignBatch(context.Background(), nil, &BatchOptions{})
+	assert.Error(t, err)
+}
+
+func TestSignBatchLegacy(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	fp := copyTestRpm(t, "testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, os.Rename(fp, filepath.Join(dir, "simple-1.0.1-1.i386.rpm")))
+	opts := &BatchOptions{Key: keyring[0], SignatureOptions: &SignatureOptions{Legacy: true}}
+	results, err := SignTree(context.Background(), dir, opts)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, BatchSigned, results[0].Status)
+	// the v3 signatures are recognized on the next run
+	results, err = SignTree(context.Background(), dir, opts)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, BatchSkipped, results[0].Status)
+}
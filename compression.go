@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PayloadCompression describes how the payload of a RPM was compressed
+type PayloadCompression struct {
+	// Compressor is the compression format, such as "xz" or "zstd"
+	Compressor string
+	// Flags is the raw value of PAYLOADFLAGS
+	Flags string
+	// Level is the compression level, or -1 if it was not recorded
+	Level int
+	// Threads is the number of threads the compressor used: -1 if it was not
+	// recorded, or 0 if rpm used one per CPU
+	Threads int
+	// WindowLog is the log2 of the zstd long distance matching window, or 0
+	// if long mode was not used
+	WindowLog int
+}
+
+// compressorSuffixes maps the rpmio type suffixes of _binary_payload to
+// PAYLOADCOMPRESSOR values
+var compressorSuffixes = map[string]string{
+	"ufdio":  "uncompressed",
+	"gzdio":  "gzip",
+	"bzdio":  "bzip2",
+	"xzdio":  "xz",
+	"lzdio":  "lzma",
+	"zstdio": "zstd",
+}
+
+// String returns the settings in the same form as rpm's _binary_payload macro
+func (c PayloadCompression) String() string {
+	s := "w"
+	if c.Level >= 0 {
+		s += strconv.Itoa(c.Level)
+	}
+	if c.Threads > 0 {
+		s += "T" + strconv.Itoa(c.Threads)
+	} else if c.Threads == 0 {
+		s += "T"
+	}
+	if c.WindowLog > 0 {
+		s += "L" + strconv.Itoa(c.WindowLog)
+	}
+	for suffix, name := range compressorSuffixes {
+		if name == c.Compressor {
+			return s + "." + suffix
+		}
+	}
+	return s
+}
+
+// ParsePayloadFlags parses compression settings in the form found in
+// PAYLOADFLAGS or rpm's _binary_payload macro, such as "9", "w19T8" or
+// "w19.zstdio". The compressor is only set if the type suffix is present.
+func ParsePayloadFlags(flags string) (PayloadCompression, error) {
+	c := PayloadCompression{Flags: flags, Level: -1, Threads: -1}
+	s := flags
+	if i := strings.LastIndexByte(s, '.'); i >= 0 {
+		name, ok := compressorSuffixes[s[i+1:]]
+		if !ok {
+			return c, fmt.Errorf("unknown payload type %q", s[i+1:])
+		}
+		c.Compressor = name
+		s = s[:i]
+	}
+	s = strings.TrimLeft(s, "rw")
+	// number returns the digits at the start of s
+	number := func() (int, bool) {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		if n == 0 {
+			return 0, false
+		}
+		v, err := strconv.Atoi(s[:n])
+		s = s[n:]
+		return v, err == nil
+	}
+	if v, ok := number(); ok {
+		c.Level = v
+	}
+	for len(s) > 0 {
+		flag := s[0]
+		s = s[1:]
+		switch flag {
+		case 'T':
+			// T without a count means one thread per CPU
+			c.Threads, _ = number()
+		case 'L':
+			v, ok := number()
+			if !ok {
+				return c, fmt.Errorf("invalid payload flags %q: L needs a window size", flags)
+			}
+			c.WindowLog = v
+		default:
+			return c, fmt.Errorf("invalid payload flags %q", flags)
+		}
+	}
+	return c, nil
+}
+
+// PayloadCompression returns the compressor and the settings recorded in
+// PAYLOADFLAGS. rpm leaves out PAYLOADCOMPRESSOR for uncompressed payloads,
+// while packages from before it existed are gzip compressed.
+func (hdr *RpmHeader) PayloadCompression() (PayloadCompression, error) {
+	c := PayloadCompression{Level: -1, Threads: -1}
+	hasFlags := hdr.HasTag(PAYLOADFLAGS)
+	if hasFlags {
+		flags, err := hdr.GetString(PAYLOADFLAGS)
+		if err != nil {
+			return c, err
+		}
+		c, err = ParsePayloadFlags(flags)
+		if err != nil {
+			return c, err
+		}
+	}
+	if hdr.HasTag(PAYLOADCOMPRESSOR) {
+		compressor, err := hdr.GetString(PAYLOADCOMPRESSOR)
+		if err != nil {
+			return c, err
+		}
+		c.Compressor = compressor
+	} else if c.Compressor != "" {
+		// from the type suffix of PAYLOADFLAGS
+	} else if hasFlags {
+		c.Compressor = "uncompressed"
+	} else {
+		c.Compressor = "gzip"
+	}
+	return c, nil
+}
+
+// CompressedPayloadSize returns the size of the compressed payload in bytes.
+// For v6 packages this is PAYLOADSIZE, otherwise it is calculated from the
+// size of the general header and payload recorded in the signature header.
+func (hdr *RpmHeader) CompressedPayloadSize() (int64, error) {
+	if hdr.genHeader.HasTag(PAYLOADSIZE) {
+		u, err := hdr.GetUint64(PAYLOADSIZE)
+		if err != nil {
+			return -1, err
+		}
+		return int64(u), nil
+	}
+	size, err := hdr.GetUint64Fallback(SIG_SIZE, SIG_LONGSIGSIZE)
+	if err != nil {
+		return -1, err
+	}
+	r := hdr.GetRange()
+	headerSize := uint64(r.End - r.Start)
+	if size < headerSize {
+		return -1, fmt.Errorf("signature header size %d is smaller than the general header", size)
+	}
+	return int64(size - headerSize), nil
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/sassoftware/go-rpmutils/cpio"
+)
+
+// InconsistencyKind identifies what did not match in an Inconsistency
+type InconsistencyKind int
+
+// Kinds of inconsistency
+const (
+	// PayloadExtraFile means the payload has a file that is not listed in the
+	// header, or has the same file more than once
+	PayloadExtraFile InconsistencyKind = iota + 1
+	// PayloadMissingFile means a file listed in the header is not in the
+	// payload, and is not a %ghost
+	PayloadMissingFile
+	// PayloadModeMismatch means the mode in the cpio header doesn't match
+	// FILEMODES
+	PayloadModeMismatch
+	// PayloadSizeMismatch means the size in the cpio header doesn't match
+	// FILESIZES
+	PayloadSizeMismatch
+	// ArchiveSizeMismatch means the size of the uncompressed payload doesn't
+	// match SIG_PAYLOADSIZE, SIG_LONGARCHIVESIZE or ARCHIVESIZE
+	ArchiveSizeMismatch
+	// SignatureSizeMismatch means the size of the general header and
+	// compressed payload doesn't match SIG_SIZE or SIG_LONGSIGSIZE
+	SignatureSizeMismatch
+)
+
+func (k InconsistencyKind) String() string {
+	switch k {
+	case PayloadExtraFile:
+		return "extra file"
+	case PayloadMissingFile:
+		return "missing file"
+	case PayloadModeMismatch:
+		return "mode"
+	case PayloadSizeMismatch:
+		return "size"
+	case ArchiveSizeMismatch:
+		return "archive size"
+	case SignatureSizeMismatch:
+		return "signature size"
+	default:
+		return "unknown"
+	}
+}
+
+// Inconsistency describes a place where the payload of a RPM doesn't match its
+// header
+type Inconsistency struct {
+	// Name of the file, or empty for the sizes of the whole package
+	Name string
+	// Kind of inconsistency
+	Kind InconsistencyKind
+	// Expected is the value from the header
+	Expected string
+	// Actual is the value from the payload
+	Actual string
+}
+
+func (c Inconsistency) String() string {
+	switch c.Kind {
+	case PayloadExtraFile:
+		return fmt.Sprintf("%s: not in header", c.Name)
+	case PayloadMissingFile:
+		return fmt.Sprintf("%s: missing from payload", c.Name)
+	case ArchiveSizeMismatch, SignatureSizeMismatch:
+		return fmt.Sprintf("%s mismatch: expected %s, got %s", c.Kind, c.Expected, c.Actual)
+	}
+	return fmt.Sprintf("%s: %s mismatch: expected %s, got %s", c.Name, c.Kind, c.Expected, c.Actual)
+}
+
+// CheckConsistency reads the payload of a RPM and checks that the cpio archive
+// matches the header: that every file is listed, no file other than a %ghost
+// is missing, and the mode and size of each entry match FILEMODES and
+// FILESIZES. It also checks the size of the uncompressed payload, and of the
+// general header and compressed payload, against those recorded in the
+// header. It returns every inconsistency found, or an error if the payload
+// can't be read.
+//
+// The contents of files are not checked; see VerifyFiles for that.
+func CheckConsistency(rpm *Rpm) ([]Inconsistency, error) {
+	files, err := rpm.Header.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	compressed := &countingReader{r: rpm.f}
+	pld, err := uncompressPayload(compressed, rpm.Header, PayloadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := pld.(io.Closer); ok {
+		defer c.Close()
+	}
+	uncompressed := &countingReader{r: pld}
+	pr := newPayloadReader(uncompressed, files)
+	seen := make([]bool, len(files))
+	var found []Inconsistency
+	for {
+		hdr, index, err := pr.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if index < 0 || seen[index] {
+			found = append(found, Inconsistency{Name: payloadName(hdr), Kind: PayloadExtraFile})
+			continue
+		}
+		seen[index] = true
+		if hdr.IsStripped() {
+			// the mode and size come from the RPM header
+			continue
+		}
+		fi := pr.files[index]
+		if hdr.Mode() != fi.Mode() {
+			found = append(found, Inconsistency{
+				Name:     fi.name,
+				Kind:     PayloadModeMismatch,
+				Expected: "0" + strconv.FormatInt(int64(fi.Mode()), 8),
+				Actual:   "0" + strconv.FormatInt(int64(hdr.Mode()), 8),
+			})
+		}
+		// FILESIZES has the size of directories on the build host, which have
+		// no contents in the payload
+		if t := fi.fileType(); t != cpio.S_ISREG && t != cpio.S_ISLNK {
+			continue
+		}
+		// all but the last member of a hardlink group are stored empty
+		size := fi.Size()
+		if pr.isLink[index] {
+			size = 0
+		}
+		if hdr.Filesize64() != size {
+			found = append(found, Inconsistency{
+				Name:     fi.name,
+				Kind:     PayloadSizeMismatch,
+				Expected: strconv.FormatInt(size, 10),
+				Actual:   strconv.FormatInt(hdr.Filesize64(), 10),
+			})
+		}
+	}
+	for i, info := range files {
+		if !seen[i] && info.Flags()&RPMFILE_GHOST == 0 {
+			found = append(found, Inconsistency{Name: info.Name(), Kind: PayloadMissingFile})
+		}
+	}
+
+	// read the padding after the cpio trailer, and anything following the
+	// compressed payload
+	if _, err := io.Copy(io.Discard, uncompressed); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, compressed); err != nil {
+		return nil, err
+	}
+	expected, err := archiveSize(rpm.Header)
+	if err != nil {
+		return nil, err
+	} else if expected >= 0 && expected != uncompressed.n {
+		found = append(found, Inconsistency{
+			Kind:     ArchiveSizeMismatch,
+			Expected: strconv.FormatInt(expected, 10),
+			Actual:   strconv.FormatInt(uncompressed.n, 10),
+		})
+	}
+	if rpm.Header.HasTag(SIG_SIZE) || rpm.Header.HasTag(SIG_LONGSIGSIZE) {
+		size, err := rpm.Header.GetUint64Fallback(SIG_SIZE, SIG_LONGSIGSIZE)
+		if err != nil {
+			return nil, err
+		}
+		r := rpm.Header.GetRange()
+		actual := int64(r.End-r.Start) + compressed.n
+		if int64(size) != actual {
+			found = append(found, Inconsistency{
+				Kind:     SignatureSizeMismatch,
+				Expected: strconv.FormatUint(size, 10),
+				Actual:   strconv.FormatInt(actual, 10),
+			})
+		}
+	}
+	return found, nil
+}
+
+// archiveSize returns the size of the uncompressed payload recorded in the
+// header, or -1 if there isn't one
+func archiveSize(hdr *RpmHeader) (int64, error) {
+	size, err := hdr.PayloadSize()
+	if !errors.As(err, new(NoSuchTagError)) {
+		return size, err
+	}
+	// very old packages have it in the general header
+	if !hdr.genHeader.HasTag(ARCHIVESIZE) {
+		return -1, nil
+	}
+	u, err := hdr.GetUint64(ARCHIVESIZE)
+	if err != nil {
+		return -1, err
+	}
+	return int64(u), nil
+}
@@ -41,8 +41,21 @@ const (
 	S_ISSOCK = 0140000 // Socket
 )
 
+// ExtractOptions controls how ExtractWithOptions extracts a cpio stream
+type ExtractOptions struct {
+	// Check, if set, is called with the header of each entry before it is
+	// extracted. Extraction stops if it returns an error.
+	Check func(*Cpio_newc_header) error
+}
+
 // Extract the contents of a cpio stream from r to the destination directory dest
 func Extract(rs io.Reader, dest string) error {
+	return ExtractWithOptions(rs, dest, ExtractOptions{})
+}
+
+// ExtractWithOptions extracts the contents of a cpio stream from r to the
+// destination directory dest as directed by opts
+func ExtractWithOptions(rs io.Reader, dest string, opts ExtractOptions) error {
 	dest = filepath.Clean(filepath.FromSlash(dest))
 	linkMap := make(map[int][]string)
 
@@ -57,6 +70,11 @@ func Extract(rs io.Reader, dest string) error {
 		if entry.Header.filename == TRAILER {
 			break
 		}
+		if opts.Check != nil {
+			if err := opts.Check(entry.Header); err != nil {
+				return err
+			}
+		}
 
 		// sanitize path
 		target := path.Clean(entry.Header.filename)
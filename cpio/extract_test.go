@@ -17,6 +17,7 @@
 package cpio
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -53,3 +54,21 @@ func TestExtractDotdot(t *testing.T) {
 		t.Error("expected file with ../ to extract into top of destdir:", err)
 	}
 }
+
+func TestExtractCheck(t *testing.T) {
+	f, err := os.Open("../testdata/foo.cpio")
+	require.NoError(t, err)
+	defer f.Close()
+
+	stop := errors.New("stop")
+	var names []string
+	err = ExtractWithOptions(f, t.TempDir(), ExtractOptions{Check: func(hdr *Cpio_newc_header) error {
+		names = append(names, hdr.Filename())
+		if len(names) == 2 {
+			return stop
+		}
+		return nil
+	}})
+	require.Equal(t, stop, err)
+	require.Len(t, names, 2)
+}
@@ -16,7 +16,10 @@
 
 package rpmutils
 
-import "fmt"
+import (
+	"crypto"
+	"fmt"
+)
 
 // NoSuchTagError is returned when a tag does not exist in the header
 type NoSuchTagError struct {
@@ -31,3 +34,42 @@ func (err NoSuchTagError) Error() string {
 func NewNoSuchTagError(tag int) NoSuchTagError {
 	return NoSuchTagError{Tag: tag}
 }
+
+// PayloadDigestError is returned when the payload does not match one of the
+// digests recorded in the header
+type PayloadDigestError struct {
+	// Tag is the tag holding the digest: PAYLOADDIGEST, PAYLOADDIGESTALT or
+	// SIG_MD5
+	Tag  int
+	Hash crypto.Hash
+}
+
+func (err PayloadDigestError) Error() string {
+	switch err.Tag {
+	case PAYLOADDIGESTALT:
+		return fmt.Sprintf("payload %s ALT digest mismatch", err.Hash)
+	case SIG_MD5:
+		return "md5 digest mismatch"
+	}
+	return fmt.Sprintf("payload %s digest mismatch", err.Hash)
+}
+
+// PayloadLimitError is returned when a payload exceeds one of the
+// PayloadLimits, or does not match the uncompressed size in the header
+type PayloadLimitError struct {
+	// Limit is the name of the PayloadLimits field that was exceeded, or
+	// "PayloadSize" for a mismatch with the header
+	Limit string
+	// File is the file that exceeded MaxFileSize
+	File string
+}
+
+func (err PayloadLimitError) Error() string {
+	switch err.Limit {
+	case "PayloadSize":
+		return "payload size does not match header"
+	case "MaxFileSize":
+		return fmt.Sprintf("%s exceeds payload MaxFileSize limit", err.File)
+	}
+	return fmt.Sprintf("payload exceeds %s limit", err.Limit)
+}
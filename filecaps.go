@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// capNames lists the Linux capabilities by number
+var capNames = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner",
+	"cap_fsetid", "cap_kill", "cap_setgid", "cap_setuid", "cap_setpcap",
+	"cap_linux_immutable", "cap_net_bind_service", "cap_net_broadcast",
+	"cap_net_admin", "cap_net_raw", "cap_ipc_lock", "cap_ipc_owner",
+	"cap_sys_module", "cap_sys_rawio", "cap_sys_chroot", "cap_sys_ptrace",
+	"cap_sys_pacct", "cap_sys_admin", "cap_sys_boot", "cap_sys_nice",
+	"cap_sys_resource", "cap_sys_time", "cap_sys_tty_config", "cap_mknod",
+	"cap_lease", "cap_audit_write", "cap_audit_control", "cap_setfcap",
+	"cap_mac_override", "cap_mac_admin", "cap_syslog", "cap_wake_alarm",
+	"cap_block_suspend", "cap_audit_read", "cap_perfmon", "cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// fileCaps holds the capability sets of a file. Files only have a single
+// effective bit, so any effective capability counts.
+type fileCaps struct {
+	permitted, inheritable, effective uint64
+}
+
+func (c fileCaps) equal(other fileCaps) bool {
+	return c.permitted == other.permitted &&
+		c.inheritable == other.inheritable &&
+		(c.effective != 0) == (other.effective != 0)
+}
+
+// parseCapText parses capabilities in the textual form used by FILECAPS and
+// setcap, e.g. "cap_net_raw,cap_net_admin=ep"
+func parseCapText(text string) (fileCaps, error) {
+	var caps fileCaps
+	for _, clause := range strings.Fields(text) {
+		i := strings.IndexAny(clause, "=+-")
+		if i < 0 {
+			return caps, fmt.Errorf("invalid capability clause %q", clause)
+		}
+		var mask uint64
+		if i == 0 || clause[:i] == "all" {
+			mask = 1<<len(capNames) - 1
+		} else {
+			for _, name := range strings.Split(clause[:i], ",") {
+				bit, err := capBit(name)
+				if err != nil {
+					return caps, err
+				}
+				mask |= 1 << bit
+			}
+		}
+		rest := clause[i:]
+		for len(rest) > 0 {
+			op := rest[0]
+			j := 1
+			for j < len(rest) && strings.IndexByte("=+-", rest[j]) < 0 {
+				j++
+			}
+			flags := rest[1:j]
+			rest = rest[j:]
+			if op == '=' {
+				caps.permitted &^= mask
+				caps.inheritable &^= mask
+				caps.effective &^= mask
+			}
+			for _, flag := range flags {
+				var set *uint64
+				switch flag {
+				case 'e':
+					set = &caps.effective
+				case 'i':
+					set = &caps.inheritable
+				case 'p':
+					set = &caps.permitted
+				default:
+					return caps, fmt.Errorf("invalid capability flag %q", flag)
+				}
+				if op == '-' {
+					*set &^= mask
+				} else {
+					*set |= mask
+				}
+			}
+		}
+	}
+	return caps, nil
+}
+
+func capBit(name string) (uint, error) {
+	name = strings.ToLower(name)
+	for i, known := range capNames {
+		if name == known {
+			return uint(i), nil
+		}
+	}
+	if n, err := strconv.ParseUint(name, 10, 6); err == nil {
+		return uint(n), nil
+	}
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
+
+// parseVfsCaps parses the security.capability extended attribute
+func parseVfsCaps(blob []byte) (fileCaps, error) {
+	var caps fileCaps
+	if len(blob) < 4 {
+		return caps, errors.New("capability attribute is truncated")
+	}
+	magic := binary.LittleEndian.Uint32(blob)
+	var words int
+	switch magic & 0xff000000 {
+	case 0x01000000:
+		words = 1
+	case 0x02000000, 0x03000000:
+		words = 2
+	default:
+		return caps, fmt.Errorf("unknown capability attribute version %08x", magic)
+	}
+	if len(blob) < 4+8*words {
+		return caps, errors.New("capability attribute is truncated")
+	}
+	for i := 0; i < words; i++ {
+		caps.permitted |= uint64(binary.LittleEndian.Uint32(blob[4+8*i:])) << (32 * i)
+		caps.inheritable |= uint64(binary.LittleEndian.Uint32(blob[8+8*i:])) << (32 * i)
+	}
+	if magic&1 != 0 {
+		caps.effective = caps.permitted | caps.inheritable
+	}
+	return caps, nil
+}
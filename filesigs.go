@@ -28,6 +28,8 @@ const (
 	PGPHASHALGO_SHA384      = 9  // SHA384
 	PGPHASHALGO_SHA512      = 10 // SHA512
 	PGPHASHALGO_SHA224      = 11 // SHA224
+	PGPHASHALGO_SHA3_256    = 12 // SHA3-256
+	PGPHASHALGO_SHA3_512    = 14 // SHA3-512
 )
 
 // GetFileAlgoName returns the name of a digest algorithm
@@ -53,6 +55,10 @@ func GetFileAlgoName(algo int) string {
 		return "sha512"
 	case PGPHASHALGO_SHA224:
 		return "sha224"
+	case PGPHASHALGO_SHA3_256:
+		return "sha3-256"
+	case PGPHASHALGO_SHA3_512:
+		return "sha3-512"
 	default:
 		return "md5"
 	}
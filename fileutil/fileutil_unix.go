@@ -21,6 +21,8 @@ package fileutil
 
 import (
 	"os"
+	"syscall"
+
 	"golang.org/x/sys/unix"
 )
 
@@ -37,3 +39,21 @@ func HasLinks(info os.FileInfo) bool {
 func Mkfifo(path string, mode uint32) error {
 	return unix.Mkfifo(path, mode)
 }
+
+// Owner returns the numeric user and group IDs of a file, if available
+func Owner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
+
+// Rdev returns the device number of a character or block device
+func Rdev(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Rdev)
+}
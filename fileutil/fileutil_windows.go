@@ -29,3 +29,11 @@ func HasLinks(info os.FileInfo) bool {
 func Mkfifo(path string, mode uint32) error {
 	return nil
 }
+
+func Owner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+func Rdev(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"crypto"
+	"encoding/binary"
+	"hash"
+)
+
+// fs-verity hash algorithms, as found in SIG_VERITYSIGNATUREALGO
+const (
+	FSVERITY_HASH_ALG_SHA256 = 1
+	FSVERITY_HASH_ALG_SHA512 = 2
+)
+
+// rpm always builds the Merkle tree with 4KiB blocks and no salt
+const verityBlockSize = 4096
+
+func verityHash(algo uint32) crypto.Hash {
+	switch algo {
+	case FSVERITY_HASH_ALG_SHA256:
+		return crypto.SHA256
+	case FSVERITY_HASH_ALG_SHA512:
+		return crypto.SHA512
+	default:
+		return 0
+	}
+}
+
+// verityHasher computes the fs-verity digest of the data written to it
+type verityHasher struct {
+	algo   uint32
+	h      hash.Hash
+	block  []byte
+	hashes []byte
+	size   uint64
+}
+
+func newVerityHasher(algo uint32) *verityHasher {
+	return &verityHasher{
+		algo:  algo,
+		h:     verityHash(algo).New(),
+		block: make([]byte, 0, verityBlockSize),
+	}
+}
+
+func (v *verityHasher) Write(d []byte) (int, error) {
+	n := len(d)
+	v.size += uint64(n)
+	for len(d) > 0 {
+		take := verityBlockSize - len(v.block)
+		if take > len(d) {
+			take = len(d)
+		}
+		v.block = append(v.block, d[:take]...)
+		d = d[take:]
+		if len(v.block) == verityBlockSize {
+			v.hashes = v.hashBlock(v.hashes, v.block)
+			v.block = v.block[:0]
+		}
+	}
+	return n, nil
+}
+
+// hashBlock appends the digest of a block, zero padded to the block size
+func (v *verityHasher) hashBlock(dest, block []byte) []byte {
+	v.h.Reset()
+	v.h.Write(block)
+	if pad := verityBlockSize - len(block); pad > 0 {
+		v.h.Write(make([]byte, pad))
+	}
+	return v.h.Sum(dest)
+}
+
+// rootHash returns the root of the Merkle tree, built by hashing each level in
+// blocks until a single digest remains
+func (v *verityHasher) rootHash() []byte {
+	if v.size == 0 {
+		return make([]byte, v.h.Size())
+	}
+	level := v.hashes
+	if len(v.block) != 0 {
+		level = v.hashBlock(level, v.block)
+	}
+	for len(level) > v.h.Size() {
+		var next []byte
+		for i := 0; i < len(level); i += verityBlockSize {
+			end := i + verityBlockSize
+			if end > len(level) {
+				end = len(level)
+			}
+			next = v.hashBlock(next, level[i:end])
+		}
+		level = next
+	}
+	return level
+}
+
+// Digest returns the fs-verity file digest, which is the digest of a
+// descriptor holding the root hash and file size
+func (v *verityHasher) Digest() []byte {
+	var desc [256]byte
+	desc[0] = 1 // version
+	desc[1] = byte(v.algo)
+	desc[2] = 12 // log2 of the block size
+	binary.LittleEndian.PutUint64(desc[8:], v.size)
+	copy(desc[16:80], v.rootHash())
+	v.h.Reset()
+	v.h.Write(desc[:])
+	return v.h.Sum(nil)
+}
+
+// formattedDigest returns the structure that fs-verity signatures are made
+// over
+func (v *verityHasher) formattedDigest() []byte {
+	digest := v.Digest()
+	buf := make([]byte, 12, 12+len(digest))
+	copy(buf, "FSVerity")
+	binary.LittleEndian.PutUint16(buf[8:], uint16(v.algo))
+	binary.LittleEndian.PutUint16(buf[10:], uint16(len(digest)))
+	return append(buf, digest...)
+}
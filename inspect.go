@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// InspectOptions configures Inspect
+type InspectOptions struct {
+	// Keyring holds the keys that signatures are verified against. If it is
+	// nil, signatures are parsed but not validated, as with Verify.
+	Keyring openpgp.EntityList
+	// Checksum is the hash of the whole file to compute. If not set, defaults
+	// to SHA256.
+	Checksum crypto.Hash
+	// Payload controls how the payload is decompressed. Its digests are always
+	// verified, and Limits can be set to read untrusted packages.
+	Payload PayloadOptions
+	// File, if set, is called with each file in the payload in order, with a
+	// reader of its contents. As with PayloadReader, only the last member of
+	// a hardlink group has contents. Nothing read has been verified until
+	// Inspect returns, so anything done with the files must be staged and
+	// only committed if Inspect succeeds. If File returns an error, Inspect
+	// stops and returns it.
+	File func(info FileInfo, contents io.Reader) error
+	// Commit, if set, is called once the whole package has been read and
+	// verified, and before Inspect returns. If it returns an error, Inspect
+	// returns it too.
+	Commit func(*Inspection) error
+}
+
+// Inspection is the result of inspecting a package with Inspect
+type Inspection struct {
+	// Header of the package
+	Header *RpmHeader
+	// Signatures are the signatures found, as returned by Verify
+	Signatures []*Signature
+	// Checksum is the digest of the whole file
+	Checksum []byte
+	// ChecksumType is the hash used for Checksum
+	ChecksumType crypto.Hash
+	// Size of the whole file in bytes
+	Size int64
+}
+
+// Inspect reads a RPM from a stream, which need not be seekable, exactly once.
+// The stream is checksummed, its signatures and digests are verified as
+// Verify does, and the files in the payload are passed to opts.File as they
+// are decompressed.
+//
+// An Inspection is only returned, and opts.Commit only called, once the end of
+// the stream has been reached and everything has been verified.
+func Inspect(stream io.Reader, opts *InspectOptions) (*Inspection, error) {
+	if opts == nil {
+		opts = new(InspectOptions)
+	}
+	checksumType := opts.Checksum
+	if checksumType == 0 {
+		checksumType = crypto.SHA256
+	} else if !checksumType.Available() {
+		return nil, fmt.Errorf("unsupported checksum hash %s", checksumType)
+	}
+	checksum := checksumType.New()
+	var size byteCountSink
+	stream = io.TeeReader(stream, io.MultiWriter(checksum, &size))
+
+	lead, sigHeader, err := readSignatureHeader(stream)
+	if err != nil {
+		return nil, err
+	}
+	headerDigestValue, headerDigestType := getHashAndType(sigHeader)
+	genHeader, err := readHeader(stream, headerDigestValue, headerDigestType, sigHeader.isSource, false)
+	if err != nil {
+		return nil, err
+	}
+	hdr := &RpmHeader{
+		lead:      lead,
+		sigHeader: sigHeader,
+		genHeader: genHeader,
+		isSource:  sigHeader.isSource,
+	}
+	sigs, hashes, payloadWriters, err := signatureDigests(sigHeader, genHeader, opts.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	// a payload signature can stand in for the digests, as with Verify
+	covered := opts.Keyring != nil && len(payloadWriters) != 0
+	var payloadSize *byteCountSink
+	if genHeader.HasTag(PAYLOADSIZE) {
+		payloadSize = new(byteCountSink)
+		payloadWriters = append(payloadWriters, payloadSize)
+	}
+	// the compressed payload goes to the signature hashes on its way to the
+	// decompressor
+	payloadOpts := opts.Payload
+	payloadOpts.VerifyDigests = true
+	pld, err := openPayload(io.TeeReader(stream, io.MultiWriter(payloadWriters...)), hdr, payloadOpts, covered)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := pld.(io.Closer); ok {
+		defer c.Close()
+	}
+	files, err := hdr.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	pr := newPayloadReader(pld, files)
+	for {
+		info, err := pr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if opts.File != nil {
+			if err := opts.File(info, struct{ io.Reader }{pr}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// the payload digests have been checked, and the stream read to the end
+	if err := checkPayloadSize(genHeader, payloadSize); err != nil {
+		return nil, err
+	}
+	for i, sig := range sigs {
+		if err := sig.validate(hashes[i]); err != nil {
+			return nil, err
+		}
+	}
+	result := &Inspection{
+		Header:       hdr,
+		Signatures:   sigs,
+		Checksum:     checksum.Sum(nil),
+		ChecksumType: checksumType,
+		Size:         int64(size),
+	}
+	if opts.Commit != nil {
+		if err := opts.Commit(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
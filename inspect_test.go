@@ -0,0 +1,120 @@
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inspectBlob inspects a RPM through a stream that can't seek, returning the
+// contents of its regular files and whether the result was committed
+func inspectBlob(blob []byte, opts *InspectOptions) (*Inspection, map[string][]byte, bool, error) {
+	staged := make(map[string][]byte)
+	committed := false
+	opts.File = func(info FileInfo, contents io.Reader) error {
+		var err error
+		staged[info.Name()], err = io.ReadAll(contents)
+		return err
+	}
+	opts.Commit = func(*Inspection) error {
+		committed = true
+		return nil
+	}
+	result, err := Inspect(struct{ io.Reader }{bytes.NewReader(blob)}, opts)
+	return result, staged, committed, err
+}
+
+func TestInspect(t *testing.T) {
+	for _, name := range []string{"payload-test-0.1-w9.gzdio.x86_64.rpm", "payload-test-0.1-w3.zstdio.x86_64.rpm", "payload-test-0.1-v6.x86_64.rpm", "simple-1.0.1-1.i386.rpm", "empty-0.1-1.x86_64.rpm"} {
+		t.Run(name, func(t *testing.T) {
+			blob, err := os.ReadFile(filepath.Join("testdata", name))
+			require.NoError(t, err)
+			result, staged, committed, err := inspectBlob(blob, &InspectOptions{})
+			require.NoError(t, err)
+			assert.True(t, committed)
+			sum := sha256.Sum256(blob)
+			assert.Equal(t, sum[:], result.Checksum)
+			assert.Equal(t, crypto.SHA256, result.ChecksumType)
+			assert.Equal(t, int64(len(blob)), result.Size)
+			_, sigs, err := Verify(bytes.NewReader(blob), nil)
+			require.NoError(t, err)
+			assert.Len(t, result.Signatures, len(sigs))
+			for name, contents := range payloadContents(t, blob) {
+				assert.Equal(t, contents, staged[name], name)
+			}
+		})
+	}
+}
+
+func TestInspectSigned(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	require.NoError(t, err)
+	var signed bytes.Buffer
+	_, err = SignRpmTo(bytes.NewReader(blob), &signed, keyring[0].PrivateKey, nil)
+	require.NoError(t, err)
+	blob = signed.Bytes()
+
+	result, _, committed, err := inspectBlob(blob, &InspectOptions{Keyring: keyring, Checksum: crypto.SHA512})
+	require.NoError(t, err)
+	assert.True(t, committed)
+	assert.Len(t, result.Signatures, 2)
+	for _, sig := range result.Signatures {
+		assert.NotNil(t, sig.Signer)
+	}
+	assert.Equal(t, crypto.SHA512, result.ChecksumType)
+	assert.Len(t, result.Checksum, 64)
+
+	// an unknown key is rejected
+	_, _, committed, err = inspectBlob(blob, &InspectOptions{Keyring: openpgp.EntityList{}})
+	var keyErr KeyNotFoundError
+	assert.ErrorAs(t, err, &keyErr)
+	assert.False(t, committed)
+}
+
+func TestInspectErrors(t *testing.T) {
+	// alter the contents of a file in an uncompressed payload
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w.ufdio.x86_64.rpm")
+	require.NoError(t, err)
+	contents := payloadContents(t, blob)
+	for _, c := range contents {
+		i := bytes.Index(blob, c)
+		require.Greater(t, i, 0)
+		blob[i] ^= 0xff
+	}
+	_, staged, committed, err := inspectBlob(blob, &InspectOptions{})
+	var digestErr PayloadDigestError
+	assert.ErrorAs(t, err, &digestErr)
+	assert.False(t, committed)
+	// the files were read, but must not be used
+	assert.Len(t, staged, len(contents))
+
+	// errors from the callbacks are returned
+	stop := errors.New("stop")
+	blob, err = os.ReadFile("testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	require.NoError(t, err)
+	_, err = Inspect(bytes.NewReader(blob), &InspectOptions{
+		File: func(FileInfo, io.Reader) error { return stop },
+	})
+	assert.Equal(t, stop, err)
+	_, err = Inspect(bytes.NewReader(blob), &InspectOptions{
+		Commit: func(*Inspection) error { return stop },
+	})
+	assert.Equal(t, stop, err)
+
+	// limits apply to the payload
+	_, err = Inspect(bytes.NewReader(blob), &InspectOptions{
+		Payload: PayloadOptions{Limits: &PayloadLimits{MaxBytes: 100}},
+	})
+	assert.ErrorAs(t, err, new(PayloadLimitError))
+}
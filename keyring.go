@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// TrustedKey is a public key loaded into a Keyring
+type TrustedKey struct {
+	Entity *openpgp.Entity
+	// Fingerprint of the primary key
+	Fingerprint []byte
+	// Origin describes where the key was loaded from: the path of a key file,
+	// the name of a gpg-pubkey header, or a package and the path within it
+	Origin string
+}
+
+// Keyring is a list of public keys along with where each one came from
+type Keyring []*TrustedKey
+
+// EntityList returns the keys in a form that can be passed to Verify
+func (k Keyring) EntityList() openpgp.EntityList {
+	entities := make(openpgp.EntityList, len(k))
+	for i, key := range k {
+		entities[i] = key.Entity
+	}
+	return entities
+}
+
+// Find returns the key with the given primary key fingerprint, or nil if there
+// isn't one
+func (k Keyring) Find(fingerprint []byte) *TrustedKey {
+	for _, key := range k {
+		if bytes.Equal(key.Fingerprint, fingerprint) {
+			return key
+		}
+	}
+	return nil
+}
+
+// LoadKeyDir loads every key file in a directory such as /etc/pki/rpm-gpg.
+// Files may hold any number of keys, either ASCII armored or binary. Files
+// that can't be parsed as keys, such as a README, are skipped as rpm does,
+// while errors reading the directory or a file are returned. Subdirectories
+// are not searched.
+func LoadKeyDir(dir string) (Keyring, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var keyring Keyring
+	for _, ent := range entries {
+		path := filepath.Join(dir, ent.Name())
+		if info, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if !info.Mode().IsRegular() {
+			continue
+		}
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseKeys(blob, path)
+		if err != nil {
+			continue
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+// LoadKeysFromHeader loads the keys held in the PUBKEYS tag of a gpg-pubkey
+// header, falling back to the armored key in DESCRIPTION if there isn't one
+func LoadKeysFromHeader(hdr *RpmHeader) (Keyring, error) {
+	return keysFromHeader(hdr.genHeader)
+}
+
+// LoadKeysFromHeaderBlob loads the keys from a gpg-pubkey header as stored in a
+// rpmdb, with or without the leading header magic
+func LoadKeysFromHeaderBlob(blob []byte) (Keyring, error) {
+	if len(blob) < 8 {
+		return nil, errors.New("header blob is truncated")
+	}
+	if binary.BigEndian.Uint32(blob) != introMagic {
+		// rpmdb omits the magic and reserved bytes
+		intro := make([]byte, 8, 8+len(blob))
+		binary.BigEndian.PutUint32(intro, introMagic)
+		blob = append(intro, blob...)
+	}
+	hdr, err := readHeader(bytes.NewReader(blob), "", 0, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return keysFromHeader(hdr)
+}
+
+func keysFromHeader(hdr *rpmHeader) (Keyring, error) {
+	origin := headerName(hdr)
+	pubkeys, err := hdr.GetStrings(PUBKEYS)
+	if errors.As(err, &NoSuchTagError{}) {
+		pubkeys, err = hdr.GetStrings(DESCRIPTION)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keyring Keyring
+	for _, pubkey := range pubkeys {
+		blob := []byte(pubkey)
+		if !isArmored(blob) {
+			blob, err = base64.StdEncoding.DecodeString(strings.TrimSpace(pubkey))
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid public key: %w", origin, err)
+			}
+		}
+		keys, err := parseKeys(blob, origin)
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+// headerName returns the name-version-release of a header. For a gpg-pubkey
+// header this identifies the key it holds.
+func headerName(hdr *rpmHeader) string {
+	var parts []string
+	for _, tag := range []int{NAME, VERSION, RELEASE} {
+		if vals, err := hdr.GetStrings(tag); err == nil && len(vals) != 0 {
+			parts = append(parts, vals[0])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// LoadKeysFromPayload loads the keys from the files of a package that are
+// flagged with RPMFILE_PUBKEY
+func LoadKeysFromPayload(rpm *Rpm) (Keyring, error) {
+	pkgName := headerName(rpm.Header.genHeader)
+	pr, err := rpm.PayloadReaderExtended()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string][]byte)
+	for {
+		info, err := pr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if info.Flags()&RPMFILE_PUBKEY == 0 || pr.IsLink() {
+			continue
+		}
+		blob, err := io.ReadAll(pr)
+		if err != nil {
+			return nil, err
+		}
+		found[info.Name()] = blob
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var keyring Keyring
+	for _, name := range names {
+		keys, err := parseKeys(found[name], pkgName+":"+name)
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+// parseKeys parses the ASCII armored or binary keys in blob
+func parseKeys(blob []byte, origin string) (Keyring, error) {
+	var entities openpgp.EntityList
+	var err error
+	if isArmored(blob) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(blob))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(blob))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", origin, err)
+	}
+	keyring := make(Keyring, len(entities))
+	for i, entity := range entities {
+		keyring[i] = &TrustedKey{
+			Entity:      entity,
+			Fingerprint: entity.PrimaryKey.Fingerprint,
+			Origin:      origin,
+		}
+	}
+	return keyring, nil
+}
+
+func isArmored(blob []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(blob), []byte("-----BEGIN "))
+}
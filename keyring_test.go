@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKeys(t *testing.T) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	fingerprint := entities[0].PrimaryKey.Fingerprint
+	var public bytes.Buffer
+	require.NoError(t, entities[0].Serialize(&public))
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	_, err = w.Write(public.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// directory of armored and binary keys
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "RPM-GPG-KEY-test"), armored.Bytes(), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "RPM-GPG-KEY-test.gpg"), public.Bytes(), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0755))
+	// files that aren't keys are skipped
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a key\n"), 0644))
+	keyring, err := LoadKeyDir(dir)
+	require.NoError(t, err)
+	require.Len(t, keyring, 2)
+	assert.Equal(t, fingerprint, keyring[0].Fingerprint)
+	assert.Equal(t, filepath.Join(dir, "RPM-GPG-KEY-test"), keyring[0].Origin)
+	assert.Equal(t, filepath.Join(dir, "RPM-GPG-KEY-test.gpg"), keyring[1].Origin)
+	assert.Same(t, keyring[0], keyring.Find(fingerprint))
+	assert.Len(t, keyring.EntityList().KeysById(entities[0].PrimaryKey.KeyId), 2)
+
+	// gpg-pubkey header, as stored in a rpmdb
+	hdr := &rpmHeader{entries: make(map[int]entry)}
+	hdr.setStrings(NAME, RPM_STRING_TYPE, []string{"gpg-pubkey"})
+	hdr.setStrings(VERSION, RPM_STRING_TYPE, []string{"d4082792"})
+	hdr.setStrings(RELEASE, RPM_STRING_TYPE, []string{"5b32db75"})
+	hdr.setStrings(DESCRIPTION, RPM_STRING_TYPE, []string{armored.String()})
+	hdr.setStrings(PUBKEYS, RPM_STRING_ARRAY_TYPE, []string{base64.StdEncoding.EncodeToString(public.Bytes())})
+	var blob bytes.Buffer
+	require.NoError(t, hdr.WriteTo(&blob, RPMTAG_HEADERIMMUTABLE))
+	for _, b := range [][]byte{blob.Bytes(), blob.Bytes()[8:]} {
+		keyring, err = LoadKeysFromHeaderBlob(b)
+		require.NoError(t, err)
+		require.Len(t, keyring, 1)
+		assert.Equal(t, fingerprint, keyring[0].Fingerprint)
+		assert.Equal(t, "gpg-pubkey-d4082792-5b32db75", keyring[0].Origin)
+	}
+	// older headers only have the armored key in the description
+	delete(hdr.entries, PUBKEYS)
+	keyring, err = keysFromHeader(hdr)
+	require.NoError(t, err)
+	require.Len(t, keyring, 1)
+	assert.Equal(t, fingerprint, keyring[0].Fingerprint)
+
+	// files flagged as public keys must hold keys
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	flags, err := rpm.Header.GetUint32s(FILEFLAGS)
+	require.NoError(t, err)
+	flags[0] |= RPMFILE_PUBKEY
+	rpm.Header.genHeader.setUint32s(FILEFLAGS, flags)
+	_, err = LoadKeysFromPayload(rpm)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "simple-1.0.1-1:/config")
+}
@@ -36,6 +36,12 @@ type PayloadReader interface {
 	IsLink() bool
 }
 
+// payloadFinisher is a payload stream with checks to make once the end of the
+// cpio archive has been reached
+type payloadFinisher interface {
+	finish() error
+}
+
 type payloadReader struct {
 	stream  io.Reader
 	cr      *cpio.Reader
@@ -82,33 +88,61 @@ func newPayloadReader(r io.Reader, files []FileInfo) *payloadReader {
 // Read() can be used to read the contents of the file. Returns io.EOF when all
 // files have been consumed.
 func (pr *payloadReader) Next() (FileInfo, error) {
+	hdr, index, err := pr.next()
+	if err != nil {
+		return nil, err
+	} else if index < 0 {
+		return nil, fmt.Errorf("invalid file \"%s\" in payload", payloadName(hdr))
+	}
+	return pr.files[index], nil
+}
+
+// next reads the next cpio header and finds the file in the RPM header that
+// it belongs to. The index is -1 if the file is not in the RPM header.
+func (pr *payloadReader) next() (*cpio.Cpio_newc_header, int, error) {
 	hdr, err := pr.cr.Next()
 	if err != nil {
+		if f, ok := pr.stream.(payloadFinisher); ok && err == io.EOF {
+			if ferr := f.finish(); ferr != nil {
+				err = ferr
+			}
+		}
 		// close decompressor on EOF, zstd in particular leaks goroutines otherwise
 		if c, ok := pr.stream.(io.Closer); ok {
 			c.Close()
 		}
-		return nil, err
+		return nil, 0, err
+	}
+	if l, ok := pr.stream.(*limitedPayload); ok {
+		if err := l.checkEntry(hdr); err != nil {
+			return nil, 0, err
+		}
 	}
 	var index int
 	if hdr.IsStripped() {
 		index = hdr.Index()
+		if index >= len(pr.files) {
+			return nil, 0, errors.New("invalid file index")
+		}
 	} else {
 		var ok bool
-		name := hdr.Filename()
-		if len(name) > 1 && name[0] == '.' && name[1] == '/' {
-			name = name[1:]
-		}
-		index, ok = pr.fileMap[name]
+		index, ok = pr.fileMap[payloadName(hdr)]
 		if !ok {
-			return nil, fmt.Errorf("invalid file \"%s\" in payload", name)
+			return hdr, -1, nil
 		}
 	}
-	if index >= len(pr.files) {
-		return nil, errors.New("invalid file index")
-	}
 	pr.index = index
-	return pr.files[index], nil
+	return hdr, index, nil
+}
+
+// payloadName returns the path of a file in the payload as it appears in the
+// RPM header
+func payloadName(hdr *cpio.Cpio_newc_header) string {
+	name := hdr.Filename()
+	if len(name) > 1 && name[0] == '.' && name[1] == '/' {
+		name = name[1:]
+	}
+	return name
 }
 
 // Read bytes from the file returned by the preceding call to Next()
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/sassoftware/go-rpmutils/cpio"
+)
+
+// PayloadIndex records where each file's contents are in the payload of a
+// RPM, along with checkpoints from which decompression can be resumed, so that
+// files can be read without decompressing everything before them. It can be
+// serialized as JSON and reused for as long as the RPM is unchanged.
+type PayloadIndex struct {
+	// Compressor is the format of the payload
+	Compressor string `json:"compressor"`
+	// PayloadOffset is the offset of the compressed payload in the RPM
+	PayloadOffset int64 `json:"payload_offset"`
+	// Files lists the files with contents in the payload
+	Files []PayloadIndexEntry `json:"files"`
+	// Checkpoints are ordered by offset, and the first is always the start of
+	// the payload
+	Checkpoints []PayloadCheckpoint `json:"checkpoints"`
+}
+
+// PayloadIndexEntry locates the contents of a file in the uncompressed payload
+type PayloadIndexEntry struct {
+	// Name is the path of the file
+	Name string `json:"name"`
+	// Offset is where the contents start in the uncompressed payload
+	Offset int64 `json:"offset"`
+	// Size is the length of the contents
+	Size int64 `json:"size"`
+}
+
+// PayloadCheckpoint is a point in the payload at which decompression can start
+type PayloadCheckpoint struct {
+	// CompressedOffset is the offset relative to the start of the payload
+	CompressedOffset int64 `json:"compressed_offset"`
+	// UncompressedOffset is the offset of the data decompressed from there
+	UncompressedOffset int64 `json:"uncompressed_offset"`
+	// State is whatever else the decompressor needs to start from here, such
+	// as the check type of a xz stream
+	State []byte `json:"state,omitempty"`
+}
+
+// checkpointFunc is called by decompressors as they reach places where
+// decoding could be resumed
+type checkpointFunc func(compressedOffset, uncompressedOffset int64, state []byte)
+
+// BuildPayloadIndex reads the whole payload of a RPM and records where each
+// file is. xz payloads are checkpointed at each block and zstd payloads at
+// each frame. An xz payload whose first block does not record its sizes or is
+// larger than 32 MiB, such as one written in a single block by a
+// single-threaded encoder, only gets the checkpoint at the start of the
+// payload.
+//
+// zstd frames can't be resumed part way through, so a zstd payload written as
+// a single frame, as rpmbuild writes them, can't be indexed beyond the start
+// of the payload either. Other formats, including gzip, can only be read from
+// the start of the payload, though OpenFileAt still saves extracting the other
+// files.
+func BuildPayloadIndex(rpm *Rpm) (*PayloadIndex, error) {
+	r, d, err := payloadDecompressor(rpm.f, rpm.Header)
+	if err != nil {
+		return nil, err
+	}
+	idx := &PayloadIndex{
+		Compressor:    d.name,
+		PayloadOffset: int64(rpm.Header.GetRange().End),
+		Checkpoints:   []PayloadCheckpoint{{}},
+	}
+	checkpoint := func(compressedOffset, uncompressedOffset int64, state []byte) {
+		// the start of the payload is already a checkpoint
+		if uncompressedOffset > idx.Checkpoints[len(idx.Checkpoints)-1].UncompressedOffset {
+			idx.Checkpoints = append(idx.Checkpoints, PayloadCheckpoint{compressedOffset, uncompressedOffset, state})
+		}
+	}
+	var pld io.Reader
+	if d.checkpointed != nil {
+		pld, err = d.checkpointed(r, checkpoint)
+	} else {
+		pld, err = d.factory(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := pld.(io.Closer); ok {
+		defer c.Close()
+	}
+	files, err := rpm.Header.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	// the cpio reader doesn't read ahead, so the count of bytes read after
+	// each header is the offset of the contents
+	counter := &countingReader{r: pld}
+	pr := newPayloadReader(counter, files)
+	// hardlinks without contents share those of the last file in the group
+	pending := make(map[uint64][]string)
+	for {
+		info, err := pr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		fi := info.(*fileInfo)
+		if fi.fileType() != cpio.S_ISREG {
+			continue
+		}
+		ino := fi.inode64()
+		if pr.IsLink() {
+			pending[ino] = append(pending[ino], fi.Name())
+			continue
+		}
+		for _, name := range append(pending[ino], fi.Name()) {
+			idx.Files = append(idx.Files, PayloadIndexEntry{Name: name, Offset: counter.n, Size: fi.Size()})
+		}
+		delete(pending, ino)
+	}
+	return idx, nil
+}
+
+// OpenFileAt opens the contents of a file in the payload of the RPM r, using
+// an index built by BuildPayloadIndex. Decompression starts from the last
+// checkpoint before the file, so only the data between them is decompressed.
+func OpenFileAt(r io.ReaderAt, idx *PayloadIndex, name string) (io.ReadCloser, error) {
+	var entry *PayloadIndexEntry
+	for i := range idx.Files {
+		if idx.Files[i].Name == name {
+			entry = &idx.Files[i]
+			break
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	if idx.Compressor == "uncompressed" {
+		return io.NopCloser(io.NewSectionReader(r, idx.PayloadOffset+entry.Offset, entry.Size)), nil
+	}
+	i := sort.Search(len(idx.Checkpoints), func(i int) bool {
+		return idx.Checkpoints[i].UncompressedOffset > entry.Offset
+	}) - 1
+	if i < 0 {
+		return nil, errors.New("payload index has no checkpoint before file")
+	}
+	cp := idx.Checkpoints[i]
+	start := idx.PayloadOffset + cp.CompressedOffset
+	section := io.NewSectionReader(r, start, math.MaxInt64-start)
+	d, _ := lookupDecompressor(idx.Compressor, nil)
+	if d == nil {
+		return nil, fmt.Errorf("Unknown compression type %s", idx.Compressor)
+	}
+	var pld io.Reader
+	var err error
+	switch {
+	case cp.CompressedOffset == 0:
+		pld, err = d.factory(section)
+	case d.resume != nil:
+		pld, err = d.resume(section, cp.State)
+	default:
+		err = fmt.Errorf("%s payloads can't be resumed from a checkpoint", d.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &indexedFile{Reader: io.LimitReader(pld, entry.Size)}
+	f.closer, _ = pld.(io.Closer)
+	if _, err := io.CopyN(io.Discard, pld, entry.Offset-cp.UncompressedOffset); err != nil {
+		f.Close()
+		return nil, noEOF(err)
+	}
+	return f, nil
+}
+
+type indexedFile struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (f *indexedFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// posReader buffers a compressed stream and tracks the offset of the next byte
+type posReader struct {
+	br  *bufio.Reader
+	pos int64
+}
+
+func newPosReader(r io.Reader) *posReader {
+	return &posReader{br: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (p *posReader) Read(d []byte) (int, error) {
+	n, err := p.br.Read(d)
+	p.pos += int64(n)
+	return n, err
+}
+
+func (p *posReader) ReadByte() (byte, error) {
+	b, err := p.br.ReadByte()
+	if err == nil {
+		p.pos++
+	}
+	return b, err
+}
+
+func (p *posReader) Peek(n int) ([]byte, error) {
+	return p.br.Peek(n)
+}
+
+func (p *posReader) Discard(n int) (int, error) {
+	n, err := p.br.Discard(n)
+	p.pos += int64(n)
+	return n, err
+}
@@ -0,0 +1,164 @@
+package rpmutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sassoftware/go-rpmutils/cpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/goleak"
+)
+
+func TestPayloadIndex(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	check := func(t *testing.T, blob []byte) *PayloadIndex {
+		rpm, err := ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		payload, err := rpm.PayloadReaderExtended()
+		require.NoError(t, err)
+		expected := make(map[string][]byte)
+		for {
+			info, err := payload.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if info.Mode()&^07777 != cpio.S_ISREG || payload.IsLink() {
+				continue
+			}
+			expected[info.Name()], err = io.ReadAll(payload)
+			require.NoError(t, err)
+		}
+
+		rpm, err = ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		idx, err := BuildPayloadIndex(rpm)
+		require.NoError(t, err)
+		// the index is reused after a round trip through JSON
+		encoded, err := json.Marshal(idx)
+		require.NoError(t, err)
+		idx = new(PayloadIndex)
+		require.NoError(t, json.Unmarshal(encoded, idx))
+
+		require.Len(t, idx.Files, len(expected))
+		for _, entry := range idx.Files {
+			f, err := OpenFileAt(bytes.NewReader(blob), idx, entry.Name)
+			require.NoError(t, err)
+			actual, err := io.ReadAll(f)
+			require.NoError(t, err)
+			assert.Equal(t, expected[entry.Name], actual, entry.Name)
+			require.NoError(t, f.Close())
+		}
+		_, err = OpenFileAt(bytes.NewReader(blob), idx, "/nonexistent")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		return idx
+	}
+	for _, payloadType := range []string{"w3.zstdio", "w6.lzdio", "w6.xzdio", "w9.bzdio", "w9.gzdio", "w.ufdio"} {
+		t.Run(payloadType, func(t *testing.T) {
+			blob, err := os.ReadFile(filepath.Join("testdata", "payload-test-0.1-"+payloadType+".x86_64.rpm"))
+			require.NoError(t, err)
+			idx := check(t, blob)
+			assert.Len(t, idx.Files, 1)
+		})
+	}
+	t.Run("w6T4.xzdio", func(t *testing.T) {
+		blob, err := os.ReadFile("testdata/payload-test-0.1-w6.xzdio.x86_64.rpm")
+		require.NoError(t, err)
+		hdr, err := ReadHeader(bytes.NewReader(blob))
+		require.NoError(t, err)
+		payload, err := os.ReadFile("testdata/payload-test.cpio.xz")
+		require.NoError(t, err)
+		blob = append(blob[:hdr.GetRange().End:hdr.GetRange().End], payload...)
+		idx := check(t, blob)
+		assert.Greater(t, len(idx.Checkpoints), 1)
+	})
+}
+
+// resumeAll decompresses from each checkpoint to the end of blob
+func resumeAll(t *testing.T, blob, expected []byte, checkpoints []PayloadCheckpoint, resume func(io.Reader, []byte) (io.Reader, error)) {
+	for _, cp := range checkpoints {
+		r, err := resume(bytes.NewReader(blob[cp.CompressedOffset:]), cp.State)
+		require.NoError(t, err)
+		actual, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, expected[cp.UncompressedOffset:], actual, "checkpoint at %d", cp.CompressedOffset)
+		if c, ok := r.(io.Closer); ok {
+			require.NoError(t, c.Close())
+		}
+	}
+}
+
+func TestZstdCheckpoints(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var expected bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&expected, "line %d\n", i)
+	}
+	data := expected.Bytes()
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(true))
+	require.NoError(t, err)
+	var blob []byte
+	for i := 0; i < 3; i++ {
+		if i != 0 {
+			// a skippable frame between each one
+			blob = append(blob, 0x5a, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3)
+		}
+		blob = enc.EncodeAll(data[i*len(data)/3:(i+1)*len(data)/3], blob)
+	}
+	require.NoError(t, enc.Close())
+
+	var checkpoints []PayloadCheckpoint
+	r, err := newZstdIndexReader(bytes.NewReader(blob), func(compressedOffset, uncompressedOffset int64, state []byte) {
+		checkpoints = append(checkpoints, PayloadCheckpoint{compressedOffset, uncompressedOffset, state})
+	})
+	require.NoError(t, err)
+	actual, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, actual)
+	require.NoError(t, r.(io.Closer).Close())
+	require.Len(t, checkpoints, 3)
+	resumeAll(t, blob, data, checkpoints, resumeZstdReader)
+}
+
+func TestXZCheckpoints(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	var expected bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&expected, "line %d\n", i)
+	}
+	blob, err := os.ReadFile("testdata/multiblock.xz")
+	require.NoError(t, err)
+	var checkpoints []PayloadCheckpoint
+	r, err := newXZIndexReader(bytes.NewReader(blob), func(compressedOffset, uncompressedOffset int64, state []byte) {
+		checkpoints = append(checkpoints, PayloadCheckpoint{compressedOffset, uncompressedOffset, state})
+	})
+	require.NoError(t, err)
+	actual, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Bytes(), actual)
+	require.NoError(t, r.(io.Closer).Close())
+	// blocks of the first stream and the one block of the second
+	require.Greater(t, len(checkpoints), 2)
+	resumeAll(t, blob, expected.Bytes(), checkpoints, resumeXZReader)
+
+	// a first block too large to buffer is streamed without checkpoints
+	defer func(orig int64) { xzMaxParallelBlock = orig }(xzMaxParallelBlock)
+	xzMaxParallelBlock = 1 << 16
+	blob = makeXZ(t, [][]byte{expected.Bytes()}, nil)
+	r, err = newXZIndexReader(bytes.NewReader(blob), func(compressedOffset, uncompressedOffset int64, state []byte) {
+		t.Errorf("unexpected checkpoint at %d", compressedOffset)
+	})
+	require.NoError(t, err)
+	assert.IsType(t, &xz.Reader{}, r)
+	actual, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Bytes(), actual)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/sassoftware/go-rpmutils/cpio"
+)
+
+// PayloadLimits bounds how much a payload may expand to when it is read, to
+// guard against decompression bombs. A zero field means no limit.
+type PayloadLimits struct {
+	// MaxBytes is the largest uncompressed payload allowed
+	MaxBytes int64
+	// MaxFiles is the largest number of entries allowed in the payload
+	MaxFiles int
+	// MaxFileSize is the largest file allowed in the payload
+	MaxFileSize int64
+	// MaxRatio is the largest allowed ratio of uncompressed to compressed
+	// size. It is only checked once ratioCheckMin bytes have been
+	// decompressed, as small payloads can legitimately compress very well.
+	MaxRatio float64
+}
+
+// ratioCheckMin is how much must be decompressed before MaxRatio is checked
+const ratioCheckMin = 1 << 20
+
+// compressedCounter counts the bytes of compressed payload read. Parallel
+// decompressors read from another goroutine, so the count is atomic.
+type compressedCounter struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *compressedCounter) Read(d []byte) (int, error) {
+	n, err := c.r.Read(d)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// limitedPayload reads a decompressed payload, failing as soon as it exceeds
+// one of the limits or the size recorded in the header
+type limitedPayload struct {
+	r          io.Reader
+	compressed *compressedCounter
+	limits     PayloadLimits
+	// declared is the size from the header, or -1 if there isn't one
+	declared int64
+	n        int64
+	files    int
+	err      error
+}
+
+// newLimitedPayload limits the payload decompressed to r from compressed
+func newLimitedPayload(r io.Reader, compressed *compressedCounter, hdr *RpmHeader, limits PayloadLimits) (*limitedPayload, error) {
+	declared, err := hdr.PayloadSize()
+	if err != nil {
+		if !errors.As(err, new(NoSuchTagError)) {
+			return nil, err
+		}
+		declared = -1
+	}
+	return &limitedPayload{
+		r:          r,
+		compressed: compressed,
+		limits:     limits,
+		declared:   declared,
+	}, nil
+}
+
+func (l *limitedPayload) Read(d []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(d)
+	l.n += int64(n)
+	switch {
+	case l.limits.MaxBytes > 0 && l.n > l.limits.MaxBytes:
+		l.err = PayloadLimitError{Limit: "MaxBytes"}
+	case l.declared >= 0 && l.n > l.declared:
+		l.err = PayloadLimitError{Limit: "PayloadSize"}
+	case l.limits.MaxRatio > 0 && l.n >= ratioCheckMin && float64(l.n) > l.limits.MaxRatio*float64(l.compressed.n.Load()):
+		l.err = PayloadLimitError{Limit: "MaxRatio"}
+	case err == io.EOF && l.declared >= 0 && l.n != l.declared:
+		l.err = PayloadLimitError{Limit: "PayloadSize"}
+	default:
+		return n, err
+	}
+	// nothing more is read, so stop any decompression in the background
+	l.Close()
+	// the data that went over the limit is not passed on
+	return 0, l.err
+}
+
+// checkEntry counts an entry in the payload and checks its size
+func (l *limitedPayload) checkEntry(hdr *cpio.Cpio_newc_header) error {
+	l.files++
+	if l.limits.MaxFiles > 0 && l.files > l.limits.MaxFiles {
+		return PayloadLimitError{Limit: "MaxFiles"}
+	} else if l.limits.MaxFileSize > 0 && hdr.Filesize64() > l.limits.MaxFileSize {
+		return PayloadLimitError{Limit: "MaxFileSize", File: hdr.Filename()}
+	}
+	return nil
+}
+
+// finish reads the rest of the payload, which checks its size, then finishes
+// any verification beneath it
+func (l *limitedPayload) finish() error {
+	if _, err := io.Copy(io.Discard, l); err != nil {
+		return err
+	}
+	if f, ok := l.r.(payloadFinisher); ok {
+		return f.finish()
+	}
+	return nil
+}
+
+// Close closes the decompressor
+func (l *limitedPayload) Close() error {
+	if c, ok := l.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// payloadCompressor makes the payloads written by Recompress
+type payloadCompressor struct {
+	defaultLevel int
+	maxLevel     int
+	newWriter    func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+// xzDictCaps are the dictionary sizes of the xz and lzma presets
+var xzDictCaps = [10]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// payloadCompressors are the formats Recompress can write, with the same
+// default levels as rpm's _binary_payload macro has used for each
+var payloadCompressors = map[string]payloadCompressor{
+	"gzip": {9, 9, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	}},
+	"zstd": {19, 22, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}},
+	"xz": {2, 9, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	}},
+	"lzma": {6, 9, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return lzma.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	}},
+	"uncompressed": {0, 0, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	}},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Recompress reads a RPM from in and writes it to out with the payload
+// recompressed using codec, which is a PAYLOADCOMPRESSOR value such as "zstd"
+// or "xz". level is in the codec's own scale, or -1 for the default.
+//
+// The payload is checked against its digests as it is read. The payload tags
+// and sizes, header digests and SIG_MD5 are updated to match the new payload,
+// and signatures, which no longer match, are removed.
+func Recompress(in io.Reader, out io.Writer, codec string, level int) (*RpmHeader, error) {
+	return RecompressAndSign(in, out, codec, level, nil, nil)
+}
+
+// RecompressAndSign recompresses a RPM like Recompress, then signs it with key
+// the same way as SignRpmTo. If key is nil, the result is left unsigned.
+func RecompressAndSign(in io.Reader, out io.Writer, codec string, level int, key *packet.PrivateKey, opts *SignatureOptions) (*RpmHeader, error) {
+	if key == nil {
+		return recompress(in, out, codec, level)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := recompress(in, pw, codec, level)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	header, err := signStream(pr, out, key, opts)
+	// stop the recompression if signing failed early
+	pr.Close()
+	recompressErr := <-done
+	if err != nil {
+		return nil, err
+	} else if recompressErr != nil {
+		return nil, recompressErr
+	}
+	return header, nil
+}
+
+func recompress(in io.Reader, out io.Writer, codec string, level int) (*RpmHeader, error) {
+	compressor, ok := payloadCompressors[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported payload compressor %s", codec)
+	}
+	if level < 0 {
+		level = compressor.defaultLevel
+	} else if level > compressor.maxLevel {
+		return nil, fmt.Errorf("invalid %s compression level %d", codec, level)
+	}
+	header, err := ReadHeader(in)
+	if err != nil {
+		return nil, err
+	}
+	sigHeader, genHeader := header.sigHeader, header.genHeader
+	digestType := crypto.SHA256
+	digestAlgo := uint32(HASH_SHA256)
+	if algos, err := genHeader.GetUint32s(PAYLOADDIGESTALGO); err == nil && len(algos) == 1 {
+		digestType, digestAlgo = hashFromAlgo(algos[0]), algos[0]
+		if digestType == 0 || !digestType.Available() {
+			return nil, fmt.Errorf("unknown payload digest algorithm %d", algos[0])
+		}
+	}
+
+	// recompress to a spool, as the header must be written before the payload
+	sp := newSpool(spoolMemoryLimit)
+	defer sp.Close()
+	payloadHasher := digestType.New()
+	var payloadSize byteCountSink
+	w, err := compressor.newWriter(io.MultiWriter(sp, payloadHasher, &payloadSize), level)
+	if err != nil {
+		return nil, err
+	}
+	if err := recompressPayload(header, in, w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// update the general header to describe the new payload
+	if codec == "uncompressed" {
+		// as rpm does
+		delete(genHeader.entries, PAYLOADCOMPRESSOR)
+		genHeader.setStrings(PAYLOADFLAGS, RPM_STRING_TYPE, []string{""})
+	} else {
+		genHeader.setStrings(PAYLOADCOMPRESSOR, RPM_STRING_TYPE, []string{codec})
+		genHeader.setStrings(PAYLOADFLAGS, RPM_STRING_TYPE, []string{strconv.Itoa(level)})
+	}
+	genHeader.setStrings(PAYLOADDIGEST, RPM_STRING_ARRAY_TYPE, []string{hex.EncodeToString(payloadHasher.Sum(nil))})
+	genHeader.setUint32s(PAYLOADDIGESTALGO, []uint32{digestAlgo})
+	if genHeader.HasTag(PAYLOADSIZE) {
+		genHeader.setUint64s(PAYLOADSIZE, []uint64{uint64(payloadSize)})
+	}
+	var buf bytes.Buffer
+	if err := genHeader.WriteTo(&buf, RPMTAG_HEADERIMMUTABLE); err != nil {
+		return nil, err
+	}
+	genHeader.orig = buf.Bytes()
+
+	// then the digests and sizes in the signature header
+	removeSignatures(sigHeader)
+	headerDigests := []struct {
+		tag int
+		h   hash.Hash
+	}{
+		{SIG_SHA1, sha1.New()},
+		{SIG_SHA256, sha256.New()},
+		{SIG_SHA3_256, crypto.SHA3_256.New()},
+	}
+	for _, d := range headerDigests {
+		if sigHeader.HasTag(d.tag) {
+			d.h.Write(genHeader.orig)
+			sigHeader.setStrings(d.tag, RPM_STRING_TYPE, []string{hex.EncodeToString(d.h.Sum(nil))})
+		}
+	}
+	if sigHeader.HasTag(SIG_MD5 - _SIGHEADER_TAG_BASE) {
+		h := md5.New()
+		h.Write(genHeader.orig)
+		if _, err := sp.WriteTo(h); err != nil {
+			return nil, err
+		}
+		insertSignature(sigHeader, SIG_MD5-_SIGHEADER_TAG_BASE, h.Sum(nil))
+	}
+	if sigHeader.HasTag(SIG_SIZE-_SIGHEADER_TAG_BASE) || sigHeader.HasTag(SIG_LONGSIGSIZE) {
+		size := uint64(len(genHeader.orig)) + uint64(payloadSize)
+		delete(sigHeader.entries, SIG_SIZE-_SIGHEADER_TAG_BASE)
+		delete(sigHeader.entries, SIG_LONGSIGSIZE)
+		if size < 1<<32 {
+			sigHeader.setUint32s(SIG_SIZE-_SIGHEADER_TAG_BASE, []uint32{uint32(size)})
+		} else {
+			sigHeader.setUint64s(SIG_LONGSIGSIZE, []uint64{size})
+		}
+	}
+
+	if err := writeSignedHeaders(out, header); err != nil {
+		return nil, err
+	}
+	if _, err := sp.WriteTo(out); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// recompressPayload decompresses the payload from in and writes it to w,
+// checking it against the digests of the original compressed payload and the
+// uncompressed one
+func recompressPayload(header *RpmHeader, in io.Reader, w io.Writer) error {
+	sigHeader, genHeader := header.sigHeader, header.genHeader
+	// the compressed payload is checked in the background as it is read
+	pr, pw := io.Pipe()
+	checked := make(chan error, 1)
+	go func() {
+		err := digestPayload(sigHeader, genHeader, pr, nil, true)
+		pr.CloseWithError(err)
+		checked <- err
+	}()
+	feeder := &pipeFeeder{w: pw}
+	compressed := io.TeeReader(in, feeder)
+	err := func() error {
+		pld, err := uncompressRpmPayloadReader(compressed, header)
+		if err != nil {
+			return err
+		}
+		if c, ok := pld.(io.Closer); ok {
+			defer c.Close()
+		}
+		// the uncompressed payload is unchanged, so PAYLOADDIGESTALT still
+		// applies to it
+		writers := []io.Writer{w}
+		altValue, altType := getPayloadDigestTag(genHeader, PAYLOADDIGESTALT)
+		var altHasher hash.Hash
+		if altType != 0 && altType.Available() {
+			altHasher = altType.New()
+			writers = append(writers, altHasher)
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), pld); err != nil {
+			return err
+		}
+		if altHasher != nil && hex.EncodeToString(altHasher.Sum(nil)) != altValue {
+			return PayloadDigestError{Tag: PAYLOADDIGESTALT, Hash: altType}
+		}
+		return nil
+	}()
+	// digest anything the decompressor didn't read, so that a corrupt payload
+	// is reported as such even if decompression failed
+	if _, copyErr := io.Copy(io.Discard, compressed); err == nil {
+		err = copyErr
+	}
+	pw.Close()
+	if checkErr := <-checked; checkErr != nil {
+		return checkErr
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package rpmutils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// payloadContents reads every file in the payload of a RPM
+func payloadContents(t *testing.T, blob []byte) map[string][]byte {
+	rpm, err := ReadRpm(bytes.NewReader(blob))
+	require.NoError(t, err)
+	payload, err := rpm.PayloadReaderExtended()
+	require.NoError(t, err)
+	contents := make(map[string][]byte)
+	for {
+		info, err := payload.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		contents[info.Name()], err = io.ReadAll(payload)
+		require.NoError(t, err)
+	}
+	return contents
+}
+
+func TestRecompress(t *testing.T) {
+	for _, name := range []string{"payload-test-0.1-w9.gzdio.x86_64.rpm", "payload-test-0.1-w3.zstdio.x86_64.rpm", "payload-test-0.1-v6.x86_64.rpm"} {
+		blob, err := os.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		expected := payloadContents(t, blob)
+		for _, codec := range []string{"zstd", "xz", "gzip", "lzma", "uncompressed"} {
+			t.Run(name+"/"+codec, func(t *testing.T) {
+				var out bytes.Buffer
+				_, err := Recompress(bytes.NewReader(blob), &out, codec, -1)
+				require.NoError(t, err)
+				recompressed := out.Bytes()
+				hdr, sigs, err := Verify(bytes.NewReader(recompressed), nil)
+				require.NoError(t, err)
+				assert.Empty(t, sigs)
+				c, err := hdr.PayloadCompression()
+				require.NoError(t, err)
+				assert.Equal(t, codec, c.Compressor)
+				assert.Equal(t, expected, payloadContents(t, recompressed))
+				size, err := hdr.CompressedPayloadSize()
+				require.NoError(t, err)
+				assert.Equal(t, int64(len(recompressed)-hdr.GetRange().End), size)
+			})
+		}
+	}
+}
+
+func TestRecompressErrors(t *testing.T) {
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	require.NoError(t, err)
+	_, err = Recompress(bytes.NewReader(blob), io.Discard, "bzip2", -1)
+	assert.EqualError(t, err, "unsupported payload compressor bzip2")
+	_, err = Recompress(bytes.NewReader(blob), io.Discard, "gzip", 12)
+	assert.EqualError(t, err, "invalid gzip compression level 12")
+
+	// corrupt the end of the payload
+	blob = append([]byte(nil), blob...)
+	blob[len(blob)-10] ^= 0xff
+	_, err = Recompress(bytes.NewReader(blob), io.Discard, "zstd", 3)
+	assert.ErrorContains(t, err, "digest mismatch")
+}
+
+func TestRecompressAndSign(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	require.NoError(t, err)
+	var out bytes.Buffer
+	// hide Seek from the signer
+	in := struct{ io.Reader }{bytes.NewReader(blob)}
+	_, err = RecompressAndSign(in, &out, "zstd", 19, keyring[0].PrivateKey, nil)
+	require.NoError(t, err)
+	hdr, sigs, err := Verify(bytes.NewReader(out.Bytes()), keyring)
+	require.NoError(t, err)
+	assert.Len(t, sigs, 2)
+	c, err := hdr.PayloadCompression()
+	require.NoError(t, err)
+	assert.Equal(t, "w19.zstdio", c.String())
+}
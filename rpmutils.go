@@ -57,14 +57,64 @@ func ReadRpm(f io.Reader) (*Rpm, error) {
 
 // ExpandPayload extracts the payload of a RPM to the specified directory
 func (rpm *Rpm) ExpandPayload(dest string) error {
-	pld, err := uncompressRpmPayloadReader(rpm.f, rpm.Header)
+	return rpm.ExpandPayloadWithOptions(dest, PayloadOptions{})
+}
+
+// ExpandPayloadWithOptions extracts the payload of a RPM to the specified
+// directory, decompressing it as directed by opts
+func (rpm *Rpm) ExpandPayloadWithOptions(dest string, opts PayloadOptions) error {
+	pld, err := rpm.openPayload(opts)
 	if err != nil {
 		return err
 	}
 	if c, ok := pld.(io.Closer); ok {
 		defer c.Close()
 	}
-	return cpio.Extract(pld, dest)
+	var extractOpts cpio.ExtractOptions
+	if l, ok := pld.(*limitedPayload); ok {
+		extractOpts.Check = l.checkEntry
+	}
+	if err := cpio.ExtractWithOptions(pld, dest, extractOpts); err != nil {
+		return err
+	}
+	if f, ok := pld.(payloadFinisher); ok {
+		return f.finish()
+	}
+	return nil
+}
+
+// openPayload decompresses the payload, checking its digests and limiting its
+// size if requested
+func (rpm *Rpm) openPayload(opts PayloadOptions) (io.Reader, error) {
+	return openPayload(rpm.f, rpm.Header, opts, false)
+}
+
+// openPayload decompresses the payload from r as directed by opts. covered is
+// passed on to newVerifiedPayload.
+func openPayload(r io.Reader, hdr *RpmHeader, opts PayloadOptions, covered bool) (io.Reader, error) {
+	var compressed *compressedCounter
+	if opts.Limits != nil {
+		compressed = &compressedCounter{r: r}
+		r = compressed
+	}
+	var pld io.Reader
+	var err error
+	if opts.VerifyDigests {
+		pld, err = newVerifiedPayload(r, hdr, opts, covered)
+	} else {
+		pld, err = uncompressPayload(r, hdr, opts)
+	}
+	if err != nil || opts.Limits == nil {
+		return pld, err
+	}
+	l, err := newLimitedPayload(pld, compressed, hdr, *opts.Limits)
+	if err != nil {
+		if c, ok := pld.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
+	}
+	return l, nil
 }
 
 // PayloadReader accesses the payload cpio archive within the RPM.
@@ -80,7 +130,15 @@ func (rpm *Rpm) PayloadReader() (*cpio.Reader, error) {
 
 // PayloadReaderExtended accesses payload file contents sequentially
 func (rpm *Rpm) PayloadReaderExtended() (PayloadReader, error) {
-	pld, err := uncompressRpmPayloadReader(rpm.f, rpm.Header)
+	return rpm.PayloadReaderWithOptions(PayloadOptions{})
+}
+
+// PayloadReaderWithOptions accesses payload file contents sequentially,
+// decompressing them as directed by opts. Background decompression stops once
+// Next returns an error, including io.EOF, so the payload should be read to the
+// end.
+func (rpm *Rpm) PayloadReaderWithOptions(opts PayloadOptions) (PayloadReader, error) {
+	pld, err := rpm.openPayload(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -309,6 +367,14 @@ func (hdr *RpmHeader) InstalledSize() (int64, error) {
 
 // PayloadSize returns the size of the uncompressed payload in bytes
 func (hdr *RpmHeader) PayloadSize() (int64, error) {
+	if hdr.genHeader.HasTag(PAYLOADSIZEALT) {
+		// v6 packages keep the sizes in the general header only
+		u, err := hdr.GetUint64(PAYLOADSIZEALT)
+		if err != nil {
+			return -1, err
+		}
+		return int64(u), nil
+	}
 	u, err := hdr.sigHeader.GetUint64Fallback(SIG_PAYLOADSIZE-_SIGHEADER_TAG_BASE, SIG_LONGARCHIVESIZE)
 	if err != nil {
 		return -1, err
@@ -318,6 +384,19 @@ func (hdr *RpmHeader) PayloadSize() (int64, error) {
 	return int64(u[0]), err
 }
 
+// FormatVersion returns the version of the package format, which is 4 unless
+// the package records a later one in RPMFORMAT
+func (hdr *RpmHeader) FormatVersion() (int, error) {
+	if !hdr.genHeader.HasTag(RPMFORMAT) {
+		return 4, nil
+	}
+	v, err := hdr.GetUint32(RPMFORMAT)
+	if err != nil {
+		return -1, err
+	}
+	return int(v), nil
+}
+
 // IsSource return isSource
 func (hdr *RpmHeader) IsSource() bool {
 	return hdr.isSource
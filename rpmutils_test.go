@@ -17,11 +17,19 @@
 package rpmutils
 
 import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"testing/iotest"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 func TestReadHeader(t *testing.T) {
@@ -147,3 +155,360 @@ func TestExpandPayload(t *testing.T) {
 	tmpdir := t.TempDir()
 	require.NoError(t, rpm.ExpandPayload(tmpdir))
 }
+
+func TestPayloadVerifyDigests(t *testing.T) {
+	readAll := func(blob []byte) error {
+		rpm, err := ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		payload, err := rpm.PayloadReaderWithOptions(PayloadOptions{VerifyDigests: true})
+		require.NoError(t, err)
+		for {
+			if _, err := payload.Next(); err != nil {
+				return err
+			}
+			if _, err := io.Copy(io.Discard, payload); err != nil {
+				return err
+			}
+		}
+	}
+	expand := func(blob []byte) error {
+		rpm, err := ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		return rpm.ExpandPayloadWithOptions(t.TempDir(), PayloadOptions{VerifyDigests: true})
+	}
+	for _, name := range []string{"payload-test-0.1-w9.gzdio.x86_64.rpm", "payload-test-0.1-v6.x86_64.rpm", "simple-1.0.1-1.i386.rpm"} {
+		blob, err := os.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		assert.Equal(t, io.EOF, readAll(blob), name)
+		assert.NoError(t, expand(blob), name)
+	}
+
+	// alter the contents of a file in an uncompressed payload
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w.ufdio.x86_64.rpm")
+	require.NoError(t, err)
+	require.Equal(t, io.EOF, readAll(blob))
+	for _, contents := range payloadContents(t, blob) {
+		i := bytes.Index(blob, contents)
+		require.Greater(t, i, 0)
+		blob[i] ^= 0xff
+	}
+	var digestErr PayloadDigestError
+	require.ErrorAs(t, readAll(blob), &digestErr)
+	assert.Equal(t, PAYLOADDIGEST, digestErr.Tag)
+	assert.ErrorAs(t, expand(blob), &digestErr)
+
+	blob = sha3TestRpm(t, "testdata/payload-test-0.1-w9.gzdio.x86_64.rpm", true)
+	require.ErrorAs(t, readAll(blob), &digestErr)
+	assert.Equal(t, PayloadDigestError{Tag: PAYLOADDIGESTALT, Hash: crypto.SHA3_256}, digestErr)
+}
+
+func TestVerifyFiles(t *testing.T) {
+	for _, name := range []string{"simple-1.0.1-1.i386.rpm", "payload-test-0.1-w9.gzdio.x86_64.rpm"} {
+		f, err := os.Open("testdata/" + name)
+		require.NoError(t, err)
+		defer f.Close()
+		rpm, err := ReadRpm(f)
+		require.NoError(t, err)
+		mismatches, err := VerifyFiles(rpm)
+		require.NoError(t, err)
+		assert.Empty(t, mismatches, name)
+	}
+
+	// tamper with the header's file metadata
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	digests, err := rpm.Header.GetStrings(FILEDIGESTS)
+	require.NoError(t, err)
+	goodDigest := digests[2]
+	digests[2] = "00000000000000000000000000000000"
+	rpm.Header.genHeader.setStrings(FILEDIGESTS, RPM_STRING_ARRAY_TYPE, digests)
+	sizes, err := rpm.Header.GetUint32s(FILESIZES)
+	require.NoError(t, err)
+	sizes[0]++
+	rpm.Header.genHeader.setUint32s(FILESIZES, sizes)
+	mismatches, err := VerifyFiles(rpm)
+	require.NoError(t, err)
+	assert.Equal(t, []FileMismatch{
+		{Name: "/config", Kind: FileSizeMismatch, Expected: "8", Actual: "7"},
+		{Name: "/normal", Kind: FileDigestMismatch, Expected: "00000000000000000000000000000000", Actual: goodDigest},
+	}, mismatches)
+}
+
+func TestVerifyTree(t *testing.T) {
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	root := t.TempDir()
+	require.NoError(t, rpm.ExpandPayload(root))
+	// map the current user to the package's owner
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", "passwd"),
+		[]byte(fmt.Sprintf("root:x:%d:%d::/:/bin/sh\n", os.Getuid(), os.Getgid())), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", "group"),
+		[]byte(fmt.Sprintf("root:x:%d:\n", os.Getgid())), 0644))
+	files, err := rpm.Header.GetFiles()
+	require.NoError(t, err)
+	for _, fi := range files {
+		path := filepath.Join(root, fi.Name())
+		require.NoError(t, os.Chmod(path, os.FileMode(fi.Mode()&0777)))
+		mtime := time.Unix(int64(fi.Mtime()), 0)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	report, err := VerifyTree(root, rpm.Header)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteText(&buf, true))
+	assert.Equal(t, ".........  c /config\n.........    /dir\n.........    /normal\n", buf.String())
+
+	// change contents without changing the size or mtime, and remove a file
+	configPath := filepath.Join(root, "config")
+	st, err := os.Stat(configPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(configPath, []byte("changed"), 0644))
+	require.NoError(t, os.Chtimes(configPath, st.ModTime(), st.ModTime()))
+	require.NoError(t, os.Remove(filepath.Join(root, "normal")))
+	report, err = VerifyTree(root, rpm.Header)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	buf.Reset()
+	require.NoError(t, report.WriteText(&buf, false))
+	assert.Equal(t, "..5......  c /config\nmissing     /normal\n", buf.String())
+}
+
+func TestFileCaps(t *testing.T) {
+	caps, err := parseCapText("cap_net_raw,cap_net_admin=ep cap_chown+i")
+	require.NoError(t, err)
+	assert.Equal(t, fileCaps{permitted: 1<<13 | 1<<12, inheritable: 1 << 0, effective: 1<<13 | 1<<12}, caps)
+	// VFS_CAP_REVISION_2 with the effective bit set
+	blob := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x30, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	parsed, err := parseVfsCaps(blob)
+	require.NoError(t, err)
+	assert.True(t, caps.equal(parsed))
+	_, err = parseCapText("cap_bogus=ep")
+	assert.Error(t, err)
+}
+
+func TestPayloadLimits(t *testing.T) {
+	open := func(t *testing.T, name string) *Rpm {
+		blob, err := os.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		rpm, err := ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		return rpm
+	}
+	readAll := func(rpm *Rpm, limits PayloadLimits) error {
+		payload, err := rpm.PayloadReaderWithOptions(PayloadOptions{Limits: &limits, VerifyDigests: true})
+		require.NoError(t, err)
+		for {
+			if _, err := payload.Next(); err != nil {
+				return err
+			}
+			if _, err := io.Copy(io.Discard, payload); err != nil {
+				return err
+			}
+		}
+	}
+	expand := func(rpm *Rpm, limits PayloadLimits) error {
+		return rpm.ExpandPayloadWithOptions(t.TempDir(), PayloadOptions{Limits: &limits})
+	}
+	generous := PayloadLimits{MaxBytes: 1 << 20, MaxFiles: 10, MaxFileSize: 1 << 20, MaxRatio: 10}
+	for _, name := range []string{"payload-test-0.1-w9.gzdio.x86_64.rpm", "payload-test-0.1-w3.zstdio.x86_64.rpm", "payload-test-0.1-v6.x86_64.rpm", "empty-0.1-1.x86_64.rpm", "simple-1.0.1-1.i386.rpm"} {
+		assert.Equal(t, io.EOF, readAll(open(t, name), generous), name)
+		assert.NoError(t, expand(open(t, name), generous), name)
+	}
+
+	const name = "payload-test-0.1-w9.gzdio.x86_64.rpm"
+	for _, tc := range []struct {
+		name     string
+		limits   PayloadLimits
+		expected PayloadLimitError
+	}{
+		{name, PayloadLimits{MaxBytes: 100}, PayloadLimitError{Limit: "MaxBytes"}},
+		{"simple-1.0.1-1.i386.rpm", PayloadLimits{MaxFiles: 1}, PayloadLimitError{Limit: "MaxFiles"}},
+		{name, PayloadLimits{MaxFileSize: 5}, PayloadLimitError{Limit: "MaxFileSize", File: "./usr/share/payload-test.txt"}},
+	} {
+		var limitErr PayloadLimitError
+		require.ErrorAs(t, readAll(open(t, tc.name), tc.limits), &limitErr)
+		assert.Equal(t, tc.expected, limitErr)
+		require.ErrorAs(t, expand(open(t, tc.name), tc.limits), &limitErr)
+		assert.Equal(t, tc.expected, limitErr)
+	}
+
+	// the payload must match the size in the header
+	for _, delta := range []int64{-1, 1} {
+		rpm := open(t, name)
+		size, err := rpm.Header.PayloadSize()
+		require.NoError(t, err)
+		rpm.Header.sigHeader.setUint32s(SIG_PAYLOADSIZE-_SIGHEADER_TAG_BASE, []uint32{uint32(size + delta)})
+		var limitErr PayloadLimitError
+		require.ErrorAs(t, readAll(rpm, PayloadLimits{}), &limitErr)
+		assert.Equal(t, "PayloadSize", limitErr.Limit)
+	}
+
+	// a payload that expands too far
+	compressed := &compressedCounter{r: bytes.NewReader(make([]byte, 1000))}
+	_, err := io.Copy(io.Discard, compressed)
+	require.NoError(t, err)
+	l := &limitedPayload{
+		r:          io.LimitReader(zeroReader{}, 10<<20),
+		compressed: compressed,
+		limits:     PayloadLimits{MaxRatio: 1000},
+		declared:   -1,
+	}
+	_, err = io.Copy(io.Discard, l)
+	assert.Equal(t, PayloadLimitError{Limit: "MaxRatio"}, err)
+	assert.LessOrEqual(t, l.n, int64(2<<20))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(d []byte) (int, error) {
+	for i := range d {
+		d[i] = 0
+	}
+	return len(d), nil
+}
+
+func TestCheckConsistency(t *testing.T) {
+	names, err := filepath.Glob("testdata/*.rpm")
+	require.NoError(t, err)
+	for _, name := range names {
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		defer f.Close()
+		rpm, err := ReadRpm(f)
+		require.NoError(t, err)
+		found, err := CheckConsistency(rpm)
+		require.NoError(t, err)
+		assert.Empty(t, found, name)
+	}
+
+	// tamper with the header
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	sizes, err := rpm.Header.GetUint32s(FILESIZES)
+	require.NoError(t, err)
+	sizes[0]++
+	rpm.Header.genHeader.setUint32s(FILESIZES, sizes)
+	basenames, err := rpm.Header.GetStrings(BASENAMES)
+	require.NoError(t, err)
+	basenames[2] = "other"
+	rpm.Header.genHeader.setStrings(BASENAMES, RPM_STRING_ARRAY_TYPE, basenames)
+	archiveSize, err := rpm.Header.PayloadSize()
+	require.NoError(t, err)
+	rpm.Header.sigHeader.setUint32s(SIG_PAYLOADSIZE-_SIGHEADER_TAG_BASE, []uint32{uint32(archiveSize + 1)})
+	sigSize, err := rpm.Header.GetUint64Fallback(SIG_SIZE, SIG_LONGSIGSIZE)
+	require.NoError(t, err)
+	rpm.Header.sigHeader.setUint32s(SIG_SIZE-_SIGHEADER_TAG_BASE, []uint32{uint32(sigSize - 1)})
+	found, err := CheckConsistency(rpm)
+	require.NoError(t, err)
+	assert.Equal(t, []Inconsistency{
+		{Name: "/config", Kind: PayloadSizeMismatch, Expected: "8", Actual: "7"},
+		{Name: "/normal", Kind: PayloadExtraFile},
+		{Name: "/other", Kind: PayloadMissingFile},
+		{Kind: ArchiveSizeMismatch, Expected: fmt.Sprint(archiveSize + 1), Actual: fmt.Sprint(archiveSize)},
+		{Kind: SignatureSizeMismatch, Expected: fmt.Sprint(sigSize - 1), Actual: fmt.Sprint(sigSize)},
+	}, found)
+
+	// change a mode in an uncompressed payload
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w.ufdio.x86_64.rpm")
+	require.NoError(t, err)
+	hdr, err := ReadHeader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	start := hdr.GetRange().End
+	require.Equal(t, "070701", string(blob[start:start+6]))
+	require.Equal(t, "000081a4", string(blob[start+14:start+22]))
+	blob[start+21] = '5'
+	rpm, err = ReadRpm(bytes.NewReader(blob))
+	require.NoError(t, err)
+	found, err = CheckConsistency(rpm)
+	require.NoError(t, err)
+	assert.Equal(t, []Inconsistency{
+		{Name: "/usr/share/payload-test.txt", Kind: PayloadModeMismatch, Expected: "0100644", Actual: "0100645"},
+	}, found)
+}
+
+// TestPayloadLimitsParallel checks MaxRatio while xz blocks are decompressed
+// in the background. Run with -race.
+func TestPayloadLimitsParallel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	rpmBlob, err := os.ReadFile("testdata/payload-test-0.1-w6.xzdio.x86_64.rpm")
+	require.NoError(t, err)
+	hdr, err := ReadHeader(bytes.NewReader(rpmBlob))
+	require.NoError(t, err)
+	// build replaces the payload with a cpio archive holding one large file,
+	// compressed in blocks of blockSize that can be decoded in parallel
+	build := func(contents []byte, blockSize int) (blob []byte, archiveSize, payloadSize int) {
+		var archive bytes.Buffer
+		writeEntry := func(name string, mode int, data []byte) {
+			fmt.Fprintf(&archive, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+				1, mode, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0, name)
+			for archive.Len()%4 != 0 {
+				archive.WriteByte(0)
+			}
+			archive.Write(data)
+			for archive.Len()%4 != 0 {
+				archive.WriteByte(0)
+			}
+		}
+		writeEntry("./usr/share/payload-test.txt", 0100644, contents)
+		writeEntry("TRAILER!!!", 0, nil)
+		var chunks [][]byte
+		for data := archive.Bytes(); len(data) > 0; {
+			n := min(blockSize, len(data))
+			chunks = append(chunks, data[:n])
+			data = data[n:]
+		}
+		payload := makeXZ(t, chunks, nil)
+		blob = append(rpmBlob[:hdr.GetRange().End:hdr.GetRange().End], payload...)
+		return blob, archive.Len(), len(payload)
+	}
+	readAll := func(blob []byte, limits PayloadLimits) error {
+		rpm, err := ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		// the header describes the original payload
+		delete(rpm.Header.sigHeader.entries, SIG_PAYLOADSIZE-_SIGHEADER_TAG_BASE)
+		delete(rpm.Header.sigHeader.entries, SIG_LONGARCHIVESIZE)
+		payload, err := rpm.PayloadReaderWithOptions(PayloadOptions{Concurrency: 4, Limits: &limits})
+		require.NoError(t, err)
+		for {
+			if _, err := payload.Next(); err != nil {
+				return err
+			}
+			if _, err := io.Copy(io.Discard, payload); err != nil {
+				return err
+			}
+		}
+	}
+	var contents bytes.Buffer
+	for i := 0; contents.Len() < 4<<20; i++ {
+		fmt.Fprintf(&contents, "line %d\n", i)
+	}
+	blob, archiveSize, payloadSize := build(contents.Bytes(), 256<<10)
+	ratio := float64(archiveSize) / float64(payloadSize)
+	assert.Equal(t, io.EOF, readAll(blob, PayloadLimits{MaxRatio: ratio * 2}))
+	assert.Equal(t, PayloadLimitError{Limit: "MaxRatio"}, readAll(blob, PayloadLimits{MaxRatio: ratio / 2}))
+
+	// a highly compressible payload in blocks that would be decoded in
+	// parallel without limits
+	blob, _, _ = build(make([]byte, 64<<20), 16<<20)
+	assert.Equal(t, PayloadLimitError{Limit: "MaxBytes"}, readAll(blob, PayloadLimits{MaxBytes: 1 << 20}))
+	r, err := uncompressPayload(bytes.NewReader(blob[hdr.GetRange().End:]), hdr, PayloadOptions{Concurrency: 4, Limits: &PayloadLimits{MaxBytes: 1 << 20}})
+	require.NoError(t, err)
+	assert.IsType(t, &readaheadReader{}, r)
+	require.NoError(t, r.(io.Closer).Close())
+	r, err = uncompressPayload(bytes.NewReader(blob[hdr.GetRange().End:]), hdr, PayloadOptions{Concurrency: 4})
+	require.NoError(t, err)
+	assert.IsType(t, &parallelXZReader{}, r)
+	require.NoError(t, r.(io.Closer).Close())
+}
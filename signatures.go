@@ -19,6 +19,9 @@ package rpmutils
 import (
 	"bytes"
 	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"hash"
 	"io"
 	"os"
@@ -26,6 +29,7 @@ import (
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	_ "golang.org/x/crypto/sha3" // registers the SHA3 hashes
 
 	"github.com/sassoftware/go-rpmutils/fileutil"
 )
@@ -36,43 +40,120 @@ type SignatureOptions struct {
 	Hash crypto.Hash
 	// CreationTime for the signature. If not set, defaults to the current time
 	CreationTime time.Time
+	// Append keeps any existing signatures. The new signature is stored in the
+	// legacy tags if they are free, otherwise it is added to the OPENPGP array.
+	// If not set, the legacy signature tags are replaced.
+	Append bool
+	// HeaderOnly skips the signature over the header and payload, as rpm 4.16
+	// and later do by default. Signatures made with v6 or Ed25519/Ed448 keys
+	// are always header-only.
+	HeaderOnly bool
+	// Legacy makes signatures that EL5 and EL6 era rpm can verify. Signatures
+	// are made as v3 packets, which requires a RSA or DSA key, and the
+	// SIG_SHA1, SIG_MD5 and SIG_SIZE tags are filled in if they are missing.
+	// MD5 or SHA-1 signature hashes and keys shorter than 2048 bits are
+	// refused unless AllowWeak is also set. Verify checks these signatures
+	// without the pgp3 build tag.
+	Legacy bool
+	// AllowWeak permits weak hashes and key sizes with the Legacy profile
+	AllowWeak bool
+	// SHA3Digest adds a SHA3-256 digest of the general header to the
+	// signature header if it doesn't have one, as rpm 6 does. Older rpm
+	// ignores it.
+	SHA3Digest bool
 }
 
 func (opts *SignatureOptions) hash() crypto.Hash {
-	if opts != nil {
+	if opts != nil && opts.Hash != 0 {
 		return opts.Hash
 	}
 	return crypto.SHA256
 }
 
+func (opts *SignatureOptions) append() bool {
+	return opts != nil && opts.Append
+}
+
+func (opts *SignatureOptions) headerOnly() bool {
+	return opts != nil && opts.HeaderOnly
+}
+
+func (opts *SignatureOptions) legacy() bool {
+	return opts != nil && opts.Legacy
+}
+
+func (opts *SignatureOptions) sha3Digest() bool {
+	return opts != nil && opts.SHA3Digest
+}
+
 func (opts *SignatureOptions) creationTime() time.Time {
-	if opts != nil {
+	if opts != nil && !opts.CreationTime.IsZero() {
 		return opts.CreationTime
 	}
 	return time.Now()
 }
 
-func makeSignature(h hash.Hash, key *packet.PrivateKey, opts *SignatureOptions) ([]byte, error) {
-	hashType := opts.hash()
+// signingConfig keeps v4 signatures deterministic, as they were before salt
+// notations were introduced
+var signingConfig = &packet.Config{NonDeterministicSignaturesViaNotation: new(bool)}
+
+// pendingSignature is a signature packet whose contents are still being
+// digested
+type pendingSignature struct {
+	sig *packet.Signature
+	h   hash.Hash
+	v3  bool
+}
+
+func newPendingSignature(key *packet.PrivateKey, opts *SignatureOptions) (*pendingSignature, error) {
 	sig := &packet.Signature{
+		Version:      key.PublicKey.Version,
 		SigType:      packet.SigTypeBinary,
 		CreationTime: opts.creationTime(),
 		PubKeyAlgo:   key.PublicKey.PubKeyAlgo,
-		Hash:         hashType,
+		Hash:         opts.hash(),
 		IssuerKeyId:  &key.KeyId,
 	}
-	err := sig.Sign(h, key, nil)
+	if opts.legacy() {
+		if err := checkLegacyKey(key, opts); err != nil {
+			return nil, err
+		}
+		sig.Version = 3
+		return &pendingSignature{sig: sig, h: sig.Hash.New(), v3: true}, nil
+	}
+	// v6 signatures feed a random salt into the hash before the contents
+	h, err := sig.PrepareSign(signingConfig)
 	if err != nil {
 		return nil, err
 	}
+	return &pendingSignature{sig: sig, h: h}, nil
+}
+
+func (ps *pendingSignature) finish(key *packet.PrivateKey) ([]byte, error) {
+	if ps.v3 {
+		return ps.finishV3(key)
+	}
+	if err := ps.sig.Sign(ps.h, key, signingConfig); err != nil {
+		return nil, err
+	}
 	var buf bytes.Buffer
-	err = sig.Serialize(&buf)
-	if err != nil {
+	if err := ps.sig.Serialize(&buf); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
+// openpgpOnly returns true if signatures of the given version and algorithm
+// can only be stored in the OPENPGP array, as older versions of rpm can't parse
+// them in the legacy tags.
+func openpgpOnly(version int, algo packet.PublicKeyAlgorithm) bool {
+	switch algo {
+	case packet.PubKeyAlgoEd25519, packet.PubKeyAlgoEd448:
+		return true
+	}
+	return version >= 6
+}
+
 func insertSignature(sigHeader *rpmHeader, tag int, value []byte) {
 	sigHeader.entries[tag] = entry{
 		dataType: RPM_BIN_TYPE,
@@ -88,6 +169,68 @@ func insertSignatures(sigHeader *rpmHeader, sigPgp, sigRsa []byte) {
 	delete(sigHeader.entries, SIG_DSA)
 }
 
+// signatureSlots picks the tags where a new signature will be stored. A
+// headerTag of SIG_OPENPGP means that the signature is appended to the OPENPGP
+// array, and a payloadTag of 0 means that no header+payload signature is made.
+func signatureSlots(sigHeader *rpmHeader, version int, algo packet.PublicKeyAlgorithm, opts *SignatureOptions) (headerTag, payloadTag int) {
+	if openpgpOnly(version, algo) {
+		return SIG_OPENPGP, 0
+	}
+	headerTag, payloadTag = SIG_RSA, SIG_PGP-_SIGHEADER_TAG_BASE
+	if algo == packet.PubKeyAlgoDSA && (opts.append() || opts.legacy()) {
+		// old rpm only looks for DSA signatures in the DSA and GPG tags
+		headerTag, payloadTag = SIG_DSA, SIG_GPG-_SIGHEADER_TAG_BASE
+	}
+	if opts.append() {
+		if sigHeader.HasTag(headerTag) || sigHeader.HasTag(payloadTag) {
+			// legacy tags only hold one signature each
+			return SIG_OPENPGP, 0
+		}
+	}
+	if opts.headerOnly() {
+		payloadTag = 0
+	}
+	return
+}
+
+// storeSignatures places new signatures in the tags chosen by signatureSlots
+func storeSignatures(sigHeader *rpmHeader, headerTag, payloadTag int, sigHdr, sigPgp []byte, opts *SignatureOptions) {
+	if headerTag == SIG_OPENPGP {
+		appendOpenPGPSignature(sigHeader, sigHdr)
+		return
+	}
+	if !opts.append() {
+		// replace all legacy signatures
+		for _, tag := range headerSigTags {
+			delete(sigHeader.entries, tag)
+		}
+		for _, tag := range payloadSigTags {
+			delete(sigHeader.entries, tag)
+		}
+	}
+	insertSignature(sigHeader, headerTag, sigHdr)
+	if payloadTag != 0 {
+		insertSignature(sigHeader, payloadTag, sigPgp)
+	}
+}
+
+// storeHeaderDigests adds any missing header digests requested by opts
+func storeHeaderDigests(sigHeader, genHeader *rpmHeader, opts *SignatureOptions) {
+	if opts.sha3Digest() && !sigHeader.HasTag(SIG_SHA3_256) {
+		h := crypto.SHA3_256.New()
+		h.Write(genHeader.orig)
+		sigHeader.setStrings(SIG_SHA3_256, RPM_STRING_TYPE, []string{hex.EncodeToString(h.Sum(nil))})
+	}
+}
+
+// appendOpenPGPSignature adds a header-only signature to the OPENPGP array,
+// keeping any signatures that are already there
+func appendOpenPGPSignature(sigHeader *rpmHeader, sig []byte) {
+	vals, _ := sigHeader.GetStrings(SIG_OPENPGP)
+	vals = append(vals, base64.StdEncoding.EncodeToString(sig))
+	sigHeader.setStrings(SIG_OPENPGP, RPM_STRING_ARRAY_TYPE, vals)
+}
+
 func getSha1(sigHeader *rpmHeader) string {
 	vals, err := sigHeader.GetStrings(SIG_SHA1)
 	if err != nil {
@@ -104,27 +247,70 @@ func getSha256(sigHeader *rpmHeader) string {
 	return vals[0]
 }
 
+func getSha3_256(sigHeader *rpmHeader) string {
+	vals, err := sigHeader.GetStrings(SIG_SHA3_256)
+	if err != nil {
+		return ""
+	}
+	return vals[0]
+}
+
 func getHashAndType(sigHeader *rpmHeader) (string, crypto.Hash) {
-	// RPM v4 introduced SHA256 header signatures, prefer them over the
-	// previous SHA1
+	// RPM v6 added a SHA3-256 header digest, and RPM v4 introduced SHA256,
+	// prefer the newest over the previous SHA1
+	if h := getSha3_256(sigHeader); h != "" {
+		return h, crypto.SHA3_256
+	}
 	if h := getSha256(sigHeader); h != "" {
 		return h, crypto.SHA256
 	}
 	return getSha1(sigHeader), crypto.SHA1
 }
 
-func digestForSigning(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, opts *SignatureOptions) (genHash, combinedHash hash.Hash, err error) {
-	genHash, combinedHash = opts.hash().New(), opts.hash().New()
+// digestForSigning feeds the general header to headerWriters, and the general
+// header and payload to combinedWriters
+func digestForSigning(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, headerWriters, combinedWriters []io.Writer) error {
 	// write header
-	genHash.Write(genHeader.orig)
-	combinedHash.Write(genHeader.orig)
+	for _, w := range headerWriters {
+		if _, err := w.Write(genHeader.orig); err != nil {
+			return err
+		}
+	}
+	for _, w := range combinedWriters {
+		if _, err := w.Write(genHeader.orig); err != nil {
+			return err
+		}
+	}
 	// write and verify payload
-	err = digestPayload(sigHeader, genHeader, payloadReader, []io.Writer{combinedHash})
-	return genHash, combinedHash, err
+	return digestPayload(sigHeader, genHeader, payloadReader, combinedWriters, false)
 }
 
 // SignRpmStream reads an RPM and signs it, returning the set of headers updated with the new signature.
+//
+// Signatures made with v6 or Ed25519/Ed448 keys are appended to the OPENPGP
+// array, leaving existing signatures in place. Otherwise, the legacy PGP and
+// RSA tags are replaced unless SignatureOptions.Append is set.
 func SignRpmStream(stream io.Reader, key *packet.PrivateKey, opts *SignatureOptions) (header *RpmHeader, err error) {
+	return signStream(stream, nil, key, opts)
+}
+
+// SignRpmTo reads an RPM from a stream that need not be seekable, signs it and
+// writes the complete signed RPM to out.
+//
+// If only header signatures are being made, the signed RPM is written in a
+// single pass. The signature header keeps its original size if its reserved
+// space allows it. The payload digest is checked as it is copied, so if an
+// error is returned the output must be discarded.
+//
+// Otherwise the payload is spooled to memory, or to a temporary file if it is
+// large, until the header and payload signature has been made.
+func SignRpmTo(in io.Reader, out io.Writer, key *packet.PrivateKey, opts *SignatureOptions) (*RpmHeader, error) {
+	return signStream(in, out, key, opts)
+}
+
+// signStream reads and signs a RPM. If out is not nil, the signed RPM is also
+// written to it.
+func signStream(stream io.Reader, out io.Writer, key *packet.PrivateKey, opts *SignatureOptions) (*RpmHeader, error) {
 	lead, sigHeader, err := readSignatureHeader(stream)
 	if err != nil {
 		return nil, err
@@ -135,31 +321,119 @@ func SignRpmStream(stream io.Reader, key *packet.PrivateKey, opts *SignatureOpti
 	if err != nil {
 		return nil, err
 	}
-	// hash and sign header
-	genHash, combinedHash, err := digestForSigning(sigHeader, genHeader, stream, opts)
+	header := &RpmHeader{
+		lead:      lead,
+		sigHeader: sigHeader,
+		genHeader: genHeader,
+		isSource:  sigHeader.isSource,
+	}
+	headerSig, err := newPendingSignature(key, opts)
 	if err != nil {
 		return nil, err
 	}
-	// sign header and payload
-	sigPgp, err := makeSignature(combinedHash, key, opts)
-	if err != nil {
-		return
+	headerTag, payloadTag := signatureSlots(sigHeader, key.PublicKey.Version, key.PublicKey.PubKeyAlgo, opts)
+	if headerTag == SIG_OPENPGP && headerSig.v3 {
+		return nil, errors.New("legacy signature can't be stored alongside the existing signatures")
+	}
+	legacy := newLegacyDigests(sigHeader, opts)
+	if payloadTag == 0 && legacy == nil {
+		// the header signature can be made before reading the payload
+		sigHdr, err := signHeaderOnly(headerSig, genHeader, key)
+		if err != nil {
+			return nil, err
+		}
+		storeSignatures(sigHeader, headerTag, 0, sigHdr, nil, opts)
+		storeHeaderDigests(sigHeader, genHeader, opts)
+		var payloadWriters []io.Writer
+		if out != nil {
+			if err := writeSignedHeaders(out, header); err != nil {
+				return nil, err
+			}
+			payloadWriters = append(payloadWriters, out)
+		}
+		// verify payload
+		if err := digestPayload(sigHeader, genHeader, stream, payloadWriters, false); err != nil {
+			return nil, err
+		}
+		return header, nil
+	}
+	var combinedSig *pendingSignature
+	combinedWriters := make([]io.Writer, 0, 2)
+	if payloadTag != 0 {
+		combinedSig, err = newPendingSignature(key, opts)
+		if err != nil {
+			return nil, err
+		}
+		combinedWriters = append(combinedWriters, combinedSig.h)
+	}
+	if legacy != nil {
+		combinedWriters = append(combinedWriters, legacy)
+	}
+	payloadReader := stream
+	var sp *spool
+	if out != nil {
+		sp = newSpool(spoolMemoryLimit)
+		defer sp.Close()
+		payloadReader = io.TeeReader(stream, sp)
 	}
-	sigRsa, err := makeSignature(genHash, key, opts)
+	if err := digestForSigning(sigHeader, genHeader, payloadReader, []io.Writer{headerSig.h}, combinedWriters); err != nil {
+		return nil, err
+	}
+	// sign header, and header and payload
+	sigHdr, err := headerSig.finish(key)
 	if err != nil {
 		return nil, err
 	}
-	insertSignatures(sigHeader, sigPgp, sigRsa)
-	return &RpmHeader{
-		lead:      lead,
-		sigHeader: sigHeader,
-		genHeader: genHeader,
-		isSource:  sigHeader.isSource,
-	}, nil
+	var sigPgp []byte
+	if combinedSig != nil {
+		sigPgp, err = combinedSig.finish(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if legacy != nil {
+		legacy.store(sigHeader, genHeader)
+	}
+	storeSignatures(sigHeader, headerTag, payloadTag, sigHdr, sigPgp, opts)
+	storeHeaderDigests(sigHeader, genHeader, opts)
+	if out != nil {
+		if err := writeSignedHeaders(out, header); err != nil {
+			return nil, err
+		}
+		if _, err := sp.WriteTo(out); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+func signHeaderOnly(ps *pendingSignature, genHeader *rpmHeader, key *packet.PrivateKey) ([]byte, error) {
+	ps.h.Write(genHeader.orig)
+	return ps.finish(key)
+}
+
+// writeSignedHeaders writes the lead, updated signature header and general
+// header, which can then be followed by the original payload
+func writeSignedHeaders(out io.Writer, header *RpmHeader) error {
+	blob, err := header.DumpSignatureHeader(true)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(blob); err != nil {
+		return err
+	}
+	_, err = out.Write(header.genHeader.orig)
+	return err
 }
 
 func getPayloadDigest(header *rpmHeader) (string, crypto.Hash) {
-	digests, err := header.GetStrings(PAYLOADDIGEST)
+	return getPayloadDigestTag(header, PAYLOADDIGEST)
+}
+
+// getPayloadDigestTag returns the digest in PAYLOADDIGEST or PAYLOADDIGESTALT,
+// which share an algorithm
+func getPayloadDigestTag(header *rpmHeader, tag int) (string, crypto.Hash) {
+	digests, err := header.GetStrings(tag)
 	if err != nil || len(digests) == 0 {
 		// no payload digest
 		return "", 0
@@ -169,21 +443,33 @@ func getPayloadDigest(header *rpmHeader) (string, crypto.Hash) {
 	if err != nil || len(algos) == 0 {
 		return "", 0
 	}
-	switch algos[0] {
+	if hashType := hashFromAlgo(algos[0]); hashType != 0 {
+		return digest, hashType
+	}
+	return "", 0
+}
+
+// hashFromAlgo maps a PGP hash algorithm ID to a crypto.Hash, or 0 if unknown
+func hashFromAlgo(algo uint32) crypto.Hash {
+	switch algo {
 	case HASH_MD5:
-		return digest, crypto.MD5
+		return crypto.MD5
 	case HASH_SHA1:
-		return digest, crypto.SHA1
+		return crypto.SHA1
 	case HASH_SHA256:
-		return digest, crypto.SHA256
+		return crypto.SHA256
 	case HASH_SHA384:
-		return digest, crypto.SHA384
+		return crypto.SHA384
 	case HASH_SHA512:
-		return digest, crypto.SHA512
+		return crypto.SHA512
 	case HASH_SHA224:
-		return digest, crypto.SHA224
+		return crypto.SHA224
+	case HASH_SHA3_256:
+		return crypto.SHA3_256
+	case HASH_SHA3_512:
+		return crypto.SHA3_512
 	}
-	return "", 0
+	return 0
 }
 
 func canOverwrite(ininfo, outinfo os.FileInfo) bool {
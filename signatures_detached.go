@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ErrSigningRequestMismatch is returned when a RPM or a signature does not
+// match the SigningRequest it is being applied to
+var ErrSigningRequestMismatch = errors.New("signature does not match signing request")
+
+// SigningRequest holds everything needed to sign a RPM without access to the
+// package itself. It can be serialized as JSON and passed to an offline
+// signing server, which signs each digest with the key named by Signer. The
+// signatures are then imported with ApplySignatures.
+type SigningRequest struct {
+	// NEVRA identifies the package being signed
+	NEVRA NEVRA `json:"nevra"`
+	// SHA256 is the SIG_SHA256 digest of the general header, if present
+	SHA256 string `json:"sha256,omitempty"`
+	// PkgID is the SIG_MD5 digest of the header and payload in hex, which rpm
+	// uses to identify the package
+	PkgID string `json:"pkgid,omitempty"`
+	// Signer is the fingerprint of the key that is to make the signatures, in
+	// hex
+	Signer string `json:"signer"`
+	// Signatures holds the digests to be signed: first the one over the
+	// general header, then, unless the signature is header-only, the one over
+	// the general header and payload
+	Signatures []SigningDigest `json:"signatures"`
+}
+
+// SigningDigest is a digest for a signing server to sign. Both signatures of a
+// package are prepared the same way, as OpenPGP v4 signatures whose hashed
+// part is fixed ahead of time, so the server only makes a raw signature over
+// Digest and never needs the signed data.
+type SigningDigest struct {
+	// Hash names the digest algorithm as RFC 4880 section 9.4 does, e.g.
+	// "SHA256"
+	Hash string `json:"hash"`
+	// Digest is the hex digest to sign. It covers the signed data followed by
+	// the trailer of RFC 4880 section 5.2.4: HashedPart, the bytes 0x04 0xff,
+	// then the length of HashedPart as a 4-byte big-endian integer.
+	Digest string `json:"digest"`
+	// HashedPart is the start of the signature packet, from the version up to
+	// the end of the hashed subpackets
+	HashedPart []byte `json:"hashed_part"`
+}
+
+// SigningResponse holds the signatures made for a SigningRequest
+type SigningResponse struct {
+	// Signatures holds a signature for each digest in the request, in the
+	// same order
+	Signatures []SignatureValue `json:"signatures"`
+}
+
+// SignatureValue is a raw signature over a SigningDigest, as big-endian
+// integers. For RSA, S is the PKCS #1 v1.5 signature and R is empty. For DSA,
+// ECDSA and EdDSA, R and S are the two halves of the signature.
+type SignatureValue struct {
+	R []byte `json:"r,omitempty"`
+	S []byte `json:"s"`
+}
+
+func (v SignatureValue) mpis() [][]byte {
+	if len(v.R) == 0 {
+		return [][]byte{v.S}
+	}
+	return [][]byte{v.R, v.S}
+}
+
+// PrepareSigning reads a RPM and returns the digests that signer must sign to
+// sign it with the given options. The signer must be a v4 RSA, DSA, ECDSA or
+// EdDSA key, and the Legacy profile is not supported. The creation time of the
+// signatures is fixed when the request is prepared.
+func PrepareSigning(stream io.Reader, signer *packet.PublicKey, opts *SignatureOptions) (*SigningRequest, error) {
+	if signer.Version != 4 {
+		return nil, errors.New("detached signing requires a v4 key")
+	}
+	switch signer.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoDSA, packet.PubKeyAlgoECDSA, packet.PubKeyAlgoEdDSA:
+	default:
+		return nil, fmt.Errorf("detached signing does not support %s keys", pubKeyAlgoName(signer.PubKeyAlgo))
+	}
+	if opts.legacy() {
+		return nil, errors.New("legacy signatures can't be made by detached signing")
+	}
+	hashType := opts.hash()
+	hashAlgo, ok := pgpHashAlgo(hashType)
+	if !ok || !hashType.Available() {
+		return nil, fmt.Errorf("unsupported signature hash %s", hashType)
+	}
+	_, sigHeader, err := readSignatureHeader(stream)
+	if err != nil {
+		return nil, err
+	}
+	// parse the general header
+	headerDigestValue, headerDigestType := getHashAndType(sigHeader)
+	genHeader, err := readHeader(stream, headerDigestValue, headerDigestType, sigHeader.isSource, false)
+	if err != nil {
+		return nil, err
+	}
+	// digest header and payload
+	header := hashType.New()
+	header.Write(genHeader.orig)
+	var combined hash.Hash
+	var payloadWriters []io.Writer
+	if !opts.headerOnly() {
+		combined = hashType.New()
+		combined.Write(genHeader.orig)
+		payloadWriters = append(payloadWriters, combined)
+	}
+	if err := digestPayload(sigHeader, genHeader, stream, payloadWriters, false); err != nil {
+		return nil, err
+	}
+	nevra, err := genHeader.GetNEVRA()
+	if err != nil {
+		return nil, err
+	}
+	req := &SigningRequest{
+		NEVRA:  *nevra,
+		SHA256: getSha256(sigHeader),
+		Signer: hex.EncodeToString(signer.Fingerprint),
+	}
+	if sigmd5, err := sigHeader.GetBytes(SIG_MD5 - _SIGHEADER_TAG_BASE); err == nil {
+		req.PkgID = hex.EncodeToString(sigmd5)
+	}
+	hashedPart := v4HashedPart(signer, hashAlgo, opts.creationTime())
+	for _, h := range []hash.Hash{header, combined} {
+		if h == nil {
+			continue
+		}
+		h.Write(v4Trailer(hashedPart))
+		req.Signatures = append(req.Signatures, SigningDigest{
+			Hash:       hashName(hashType),
+			Digest:     hex.EncodeToString(h.Sum(nil)),
+			HashedPart: hashedPart,
+		})
+	}
+	return req, nil
+}
+
+// v4HashedPart returns the hashed part of a v4 binary signature packet made by
+// signer, with the creation time, issuer key ID and issuer fingerprint
+// subpackets
+func v4HashedPart(signer *packet.PublicKey, hashAlgo byte, created time.Time) []byte {
+	var subpackets bytes.Buffer
+	subpackets.Write([]byte{5, 2})
+	binary.Write(&subpackets, binary.BigEndian, uint32(created.Unix()))
+	subpackets.Write([]byte{9, 16})
+	binary.Write(&subpackets, binary.BigEndian, signer.KeyId)
+	subpackets.Write([]byte{byte(2 + len(signer.Fingerprint)), 33, byte(signer.Version)})
+	subpackets.Write(signer.Fingerprint)
+	var buf bytes.Buffer
+	buf.Write([]byte{4, byte(packet.SigTypeBinary), byte(signer.PubKeyAlgo), hashAlgo})
+	binary.Write(&buf, binary.BigEndian, uint16(subpackets.Len()))
+	buf.Write(subpackets.Bytes())
+	return buf.Bytes()
+}
+
+// v4Trailer returns what a v4 signature appends to the signed data before
+// finishing the digest
+func v4Trailer(hashedPart []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(hashedPart)
+	buf.Write([]byte{4, 0xff})
+	binary.Write(&buf, binary.BigEndian, uint32(len(hashedPart)))
+	return buf.Bytes()
+}
+
+// hash returns the algorithm named by sd.Hash
+func (sd *SigningDigest) hash() (crypto.Hash, error) {
+	for _, hashType := range []crypto.Hash{crypto.MD5, crypto.SHA1, crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		if hashName(hashType) == sd.Hash && hashType.Available() {
+			return hashType, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported signature hash %q", sd.Hash)
+}
+
+// SignRequest signs the digests in a SigningRequest, as a signing server would.
+// The key must be the one named by the request.
+func SignRequest(req *SigningRequest, key *packet.PrivateKey) (*SigningResponse, error) {
+	if !strings.EqualFold(req.Signer, hex.EncodeToString(key.Fingerprint)) {
+		return nil, fmt.Errorf("signing request is for key %s", req.Signer)
+	}
+	resp := new(SigningResponse)
+	for i := range req.Signatures {
+		hashType, err := req.Signatures[i].hash()
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(req.Signatures[i].Digest)
+		if err != nil {
+			return nil, err
+		} else if len(digest) != hashType.Size() {
+			return nil, ErrSigningRequestMismatch
+		}
+		value, err := signDigest(key, hashType, digest)
+		if err != nil {
+			return nil, err
+		}
+		resp.Signatures = append(resp.Signatures, value)
+	}
+	return resp, nil
+}
+
+// signDigest makes a raw signature over a digest that already has the
+// signature trailer folded in
+func signDigest(key *packet.PrivateKey, hashType crypto.Hash, digest []byte) (SignatureValue, error) {
+	switch priv := key.PrivateKey.(type) {
+	case *dsa.PrivateKey:
+		// DSA signs the leftmost bits of the digest that fit in Q
+		if n := (priv.Q.BitLen() + 7) / 8; len(digest) > n {
+			digest = digest[:n]
+		}
+		r, s, err := dsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return SignatureValue{}, err
+		}
+		return SignatureValue{R: r.Bytes(), S: s.Bytes()}, nil
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return SignatureValue{}, err
+		}
+		return SignatureValue{R: r.Bytes(), S: s.Bytes()}, nil
+	case *eddsa.PrivateKey:
+		r, s, err := eddsa.Sign(priv, digest)
+		if err != nil {
+			return SignatureValue{}, err
+		}
+		return SignatureValue{R: r, S: s}, nil
+	case crypto.Signer:
+		switch key.PubKeyAlgo {
+		case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+			s, err := priv.Sign(rand.Reader, digest, hashType)
+			if err != nil {
+				return SignatureValue{}, err
+			}
+			return SignatureValue{S: s}, nil
+		}
+	}
+	return SignatureValue{}, fmt.Errorf("unsupported private key type %T", key.PrivateKey)
+}
+
+// ApplySignatures inserts the signatures in resp into infile and writes the
+// result to outpath, which may be the same file. The package must be the one
+// req was prepared from, and each signature must be valid for one of
+// knownKeys, which is required.
+func ApplySignatures(infile *os.File, outpath string, req *SigningRequest, resp *SigningResponse, knownKeys openpgp.EntityList, opts *SignatureOptions) (*RpmHeader, error) {
+	if knownKeys == nil {
+		return nil, errors.New("a keyring is required to apply signatures")
+	}
+	if len(req.Signatures) == 0 || len(req.Signatures) > 2 || len(resp.Signatures) != len(req.Signatures) {
+		return nil, ErrSigningRequestMismatch
+	}
+	header, err := ReadHeader(infile)
+	if err != nil {
+		return nil, err
+	}
+	// the first signature covers the general header, and the second the
+	// general header and payload
+	blobs := make([][]byte, 2)
+	var hdrPkt *packet.Signature
+	for i := range req.Signatures {
+		hashType, err := req.Signatures[i].hash()
+		if err != nil {
+			return nil, err
+		}
+		digest, verify := hashType.New(), hashType.New()
+		w := io.MultiWriter(digest, verify)
+		w.Write(header.genHeader.orig)
+		if i == 1 {
+			if _, err := io.Copy(w, infile); err != nil {
+				return nil, err
+			}
+		}
+		pkt, blob, err := assembleSignature(&req.Signatures[i], digest, resp.Signatures[i])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDetachedSignature(pkt, verify, knownKeys); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			hdrPkt = pkt
+		}
+		blobs[i] = blob
+	}
+	headerTag, payloadTag := signatureSlots(header.sigHeader, hdrPkt.Version, hdrPkt.PubKeyAlgo, opts)
+	if blobs[1] == nil {
+		payloadTag = 0
+	} else if payloadTag == 0 {
+		return nil, errors.New("header and payload signature can't be stored alongside the existing signatures")
+	}
+	storeSignatures(header.sigHeader, headerTag, payloadTag, blobs[0], blobs[1], opts)
+	storeHeaderDigests(header.sigHeader, header.genHeader, opts)
+	if err := rewriteRpm(infile, outpath, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// assembleSignature checks that h, which holds the signed data, matches the
+// digest in sd, then builds the signature packet from sd and the value made
+// by the signer
+func assembleSignature(sd *SigningDigest, h hash.Hash, value SignatureValue) (*packet.Signature, []byte, error) {
+	h.Write(v4Trailer(sd.HashedPart))
+	digest := h.Sum(nil)
+	if hex.EncodeToString(digest) != strings.ToLower(sd.Digest) {
+		return nil, nil, ErrSigningRequestMismatch
+	}
+	var body bytes.Buffer
+	body.Write(sd.HashedPart)
+	// no unhashed subpackets
+	body.Write([]byte{0, 0})
+	body.Write(digest[:2])
+	writeMPIs(&body, value.mpis())
+	blob := signaturePacket(body.Bytes())
+	pkt, err := parseDetachedSignature(blob)
+	if err != nil {
+		return nil, nil, err
+	} else if pkt.SigType != packet.SigTypeBinary {
+		return nil, nil, ErrSigningRequestMismatch
+	}
+	return pkt, blob, nil
+}
+
+// writeMPIs writes big-endian integers in OpenPGP multiprecision format
+func writeMPIs(buf *bytes.Buffer, mpis [][]byte) {
+	for _, mpi := range mpis {
+		n := new(big.Int).SetBytes(mpi)
+		binary.Write(buf, binary.BigEndian, uint16(n.BitLen()))
+		buf.Write(n.Bytes())
+	}
+}
+
+// signaturePacket wraps the body of a signature packet in an old format packet
+// header with a 2-byte length, which is what rpm has always written
+func signaturePacket(body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | 2<<2 | 1)
+	binary.Write(&buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func parseDetachedSignature(blob []byte) (*packet.Signature, error) {
+	reader := bytes.NewReader(blob)
+	genpkt, err := packet.Read(reader)
+	if err != nil {
+		return nil, err
+	} else if reader.Len() > 0 {
+		return nil, ErrTrailingGarbage
+	}
+	pkt, ok := genpkt.(*packet.Signature)
+	if !ok {
+		return nil, ErrNoPGPSignature
+	}
+	return pkt, nil
+}
+
+// checkDetachedSignature checks that pkt was made by one of knownKeys over the
+// contents digested by h
+func checkDetachedSignature(pkt *packet.Signature, h hash.Hash, knownKeys openpgp.EntityList) error {
+	if _, key := findKey(pkt, knownKeys); key != nil {
+		return key.VerifySignature(h, pkt)
+	}
+	keyErr := KeyNotFoundError{Fingerprint: pkt.IssuerFingerprint}
+	if pkt.IssuerKeyId != nil {
+		keyErr.KeyID = *pkt.IssuerKeyId
+	}
+	return keyErr
+}
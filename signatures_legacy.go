@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ErrWeakSignature is returned when the Legacy signing profile would produce a
+// weak signature and AllowWeak is not set
+var ErrWeakSignature = errors.New("refusing to make a weak legacy signature")
+
+// minLegacyKeyBits is the smallest RSA or DSA key accepted for legacy
+// signatures without AllowWeak
+const minLegacyKeyBits = 2048
+
+// checkLegacyKey returns an error if key can't make v3 signatures, or if the
+// signature would be weak and that hasn't been allowed
+func checkLegacyKey(key *packet.PrivateKey, opts *SignatureOptions) error {
+	switch key.PublicKey.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoDSA:
+	default:
+		return fmt.Errorf("legacy signatures require a RSA or DSA key, not algorithm %d", key.PublicKey.PubKeyAlgo)
+	}
+	if key.PublicKey.Version > 4 {
+		return errors.New("legacy signatures can't be made with v6 keys")
+	}
+	if _, ok := pgpHashAlgo(opts.hash()); !ok || !opts.hash().Available() {
+		return fmt.Errorf("unsupported signature hash %s", opts.hash())
+	}
+	if opts.AllowWeak {
+		return nil
+	}
+	switch opts.hash() {
+	case crypto.MD5, crypto.SHA1:
+		return fmt.Errorf("%w: %s hash", ErrWeakSignature, opts.hash())
+	}
+	bits, err := key.PublicKey.BitLength()
+	if err != nil {
+		return err
+	} else if bits < minLegacyKeyBits {
+		return fmt.Errorf("%w: %d-bit key", ErrWeakSignature, bits)
+	}
+	return nil
+}
+
+func pgpHashAlgo(h crypto.Hash) (byte, bool) {
+	switch h {
+	case crypto.MD5:
+		return HASH_MD5, true
+	case crypto.SHA1:
+		return HASH_SHA1, true
+	case crypto.SHA224:
+		return HASH_SHA224, true
+	case crypto.SHA256:
+		return HASH_SHA256, true
+	case crypto.SHA384:
+		return HASH_SHA384, true
+	case crypto.SHA512:
+		return HASH_SHA512, true
+	}
+	return 0, false
+}
+
+// finishV3 completes a v3 signature packet. The PGP library can't make v3
+// signatures, so the packet is assembled here.
+func (ps *pendingSignature) finishV3(key *packet.PrivateKey) ([]byte, error) {
+	sig := ps.sig
+	var trailer [5]byte
+	trailer[0] = byte(sig.SigType)
+	binary.BigEndian.PutUint32(trailer[1:], uint32(sig.CreationTime.Unix()))
+	ps.h.Write(trailer[:])
+	digest := ps.h.Sum(nil)
+	hashTag := digest[:2]
+	value, err := signDigest(key, sig.Hash, digest)
+	if err != nil {
+		return nil, err
+	}
+	hashAlgo, _ := pgpHashAlgo(sig.Hash)
+	var body bytes.Buffer
+	body.Write([]byte{3, 5})
+	body.Write(trailer[:])
+	binary.Write(&body, binary.BigEndian, key.KeyId)
+	body.Write([]byte{byte(key.PublicKey.PubKeyAlgo), hashAlgo})
+	body.Write(hashTag)
+	writeMPIs(&body, value.mpis())
+	return signaturePacket(body.Bytes()), nil
+}
+
+// legacyDigests computes the digests of the header and payload that old rpm
+// requires in the signature header
+type legacyDigests struct {
+	md5  hash.Hash
+	size uint64
+}
+
+// newLegacyDigests returns nil unless the Legacy profile is in use and some of
+// the digests are missing
+func newLegacyDigests(sigHeader *rpmHeader, opts *SignatureOptions) *legacyDigests {
+	if !opts.legacy() {
+		return nil
+	}
+	if sigHeader.HasTag(SIG_SHA1) && sigHeader.HasTag(SIG_MD5-_SIGHEADER_TAG_BASE) &&
+		(sigHeader.HasTag(SIG_SIZE-_SIGHEADER_TAG_BASE) || sigHeader.HasTag(SIG_LONGSIGSIZE)) {
+		return nil
+	}
+	return &legacyDigests{md5: md5.New()}
+}
+
+func (ld *legacyDigests) Write(d []byte) (int, error) {
+	ld.size += uint64(len(d))
+	return ld.md5.Write(d)
+}
+
+// store fills in whichever of SIG_SHA1, SIG_MD5 and SIG_SIZE are missing
+func (ld *legacyDigests) store(sigHeader, genHeader *rpmHeader) {
+	if !sigHeader.HasTag(SIG_SHA1) {
+		digest := sha1.Sum(genHeader.orig)
+		sigHeader.setStrings(SIG_SHA1, RPM_STRING_TYPE, []string{hex.EncodeToString(digest[:])})
+	}
+	if !sigHeader.HasTag(SIG_MD5 - _SIGHEADER_TAG_BASE) {
+		insertSignature(sigHeader, SIG_MD5-_SIGHEADER_TAG_BASE, ld.md5.Sum(nil))
+	}
+	if !sigHeader.HasTag(SIG_SIZE-_SIGHEADER_TAG_BASE) && !sigHeader.HasTag(SIG_LONGSIGSIZE) {
+		if ld.size < 1<<32 {
+			sigHeader.setUint32s(SIG_SIZE-_SIGHEADER_TAG_BASE, []uint32{uint32(ld.size)})
+		} else {
+			sigHeader.setUint64s(SIG_LONGSIGSIZE, []uint64{ld.size})
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"crypto"
+	"os"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// SignatureInfo describes a raw signature stored in the signature header. It is
+// parsed but not verified.
+type SignatureInfo struct {
+	// Tag holding the signature, e.g. SIG_RSA, SIG_PGP or SIG_OPENPGP
+	Tag int
+	// Packet is the raw PGP signature packet
+	Packet []byte
+	// HeaderOnly is true for signatures that only cover the general RPM header
+	HeaderOnly bool
+	// KeyId is the PGP key that created the signature
+	KeyId uint64
+	// KeyFingerprint is the fingerprint of the key that created the signature,
+	// if the packet includes it
+	KeyFingerprint []byte
+	// PubKeyAlgo is the public key algorithm that created the signature
+	PubKeyAlgo packet.PublicKeyAlgorithm
+	// Hash is the algorithm used to digest the signature contents
+	Hash crypto.Hash
+	// CreationTime is when the signature was created
+	CreationTime time.Time
+	// Err is set if the packet could not be parsed, in which case only Tag,
+	// Packet and HeaderOnly are valid
+	Err error
+}
+
+// ListSignatures returns every signature found in the signature header,
+// without verifying them.
+func ListSignatures(hdr *RpmHeader) ([]SignatureInfo, error) {
+	var infos []SignatureInfo
+	for _, tag := range headerSigTags {
+		if blob, err := hdr.sigHeader.GetBytes(tag); err == nil {
+			infos = append(infos, describeSignature(tag, blob, true))
+		}
+	}
+	blobs, err := getOpenPGPSignatures(hdr.sigHeader)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		infos = append(infos, describeSignature(SIG_OPENPGP, blob, true))
+	}
+	for _, tag := range payloadSigTags {
+		if blob, err := hdr.sigHeader.GetBytes(tag); err == nil {
+			infos = append(infos, describeSignature(tag+_SIGHEADER_TAG_BASE, blob, false))
+		}
+	}
+	return infos, nil
+}
+
+func describeSignature(tag int, blob []byte, headerOnly bool) SignatureInfo {
+	info := SignatureInfo{
+		Tag:        tag,
+		Packet:     blob,
+		HeaderOnly: headerOnly,
+	}
+	sig, err := parseSignature(blob, nil)
+	if err != nil {
+		info.Err = err
+		return info
+	}
+	info.KeyId = sig.KeyId
+	info.KeyFingerprint = sig.KeyFingerprint
+	info.PubKeyAlgo = sig.PubKeyAlgo
+	info.Hash = sig.Hash
+	info.CreationTime = sig.CreationTime
+	return info
+}
+
+// removeSignatures deletes every PGP signature from the signature header
+func removeSignatures(sigHeader *rpmHeader) {
+	for _, tag := range headerSigTags {
+		delete(sigHeader.entries, tag)
+	}
+	for _, tag := range payloadSigTags {
+		delete(sigHeader.entries, tag)
+	}
+	delete(sigHeader.entries, SIG_OPENPGP)
+}
+
+// DeleteSignatures removes all PGP signatures from infile and writes it to
+// outpath, which may be the same file.
+func DeleteSignatures(infile *os.File, outpath string) (*RpmHeader, error) {
+	header, err := ReadHeader(infile)
+	if err != nil {
+		return nil, err
+	}
+	removeSignatures(header.sigHeader)
+	if err := rewriteRpm(infile, outpath, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spoolMemoryLimit is how much data a spool holds in memory before moving it
+// to a temporary file
+const spoolMemoryLimit = 16 << 20
+
+// spool buffers data in memory up to a limit, then moves it to a temporary
+// file. Close must be called to remove the file.
+type spool struct {
+	limit int
+	buf   bytes.Buffer
+	file  *os.File
+}
+
+func newSpool(limit int) *spool {
+	return &spool{limit: limit}
+}
+
+func (s *spool) Write(d []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(d) > s.limit {
+		f, err := os.CreateTemp("", "rpmutils-spool")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+	if s.file != nil {
+		return s.file.Write(d)
+	}
+	return s.buf.Write(d)
+}
+
+// WriteTo copies the spooled data to w
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		// leave the buffer intact so it can be copied again
+		n, err := w.Write(s.buf.Bytes())
+		return int64(n), err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close discards the spooled data
+func (s *spool) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	if err2 := os.Remove(name); err == nil {
+		err = err2
+	}
+	s.file = nil
+	return err
+}
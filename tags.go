@@ -108,6 +108,7 @@ const (
 	DIRNAMES          = 1118
 	PAYLOADFORMAT     = 1124
 	PAYLOADCOMPRESSOR = 1125
+	PAYLOADFLAGS      = 1126
 	FILECOLORS        = 1140
 
 	OLDSUGGESTSNAME    = 1156 // obsolete
@@ -148,19 +149,31 @@ const (
 
 	ENCODING = 5062
 
-	PAYLOADDIGEST     = 5092
-	PAYLOADDIGESTALGO = 5093
+	FILESIGNATURES      = 5090 // IMA signature of each file (hex)
+	FILESIGNATURELENGTH = 5091
+	PAYLOADDIGEST       = 5092
+	PAYLOADDIGESTALGO   = 5093
+	PAYLOADDIGESTALT    = 5097
+	PAYLOADSIZE         = 5112 // compressed payload bytes (uint64)
+	PAYLOADSIZEALT      = 5113 // uncompressed payload bytes (uint64)
+	RPMFORMAT           = 5114 // package format version, 6 or later
 )
 
 // RPM header tags found in the signature header
 const (
-	SIG_BASE            = 256
-	SIG_DSA             = SIG_BASE + 11 // DSA signature over header only
-	SIG_RSA             = SIG_BASE + 12 // RSA signature over header only
-	SIG_SHA1            = SIG_BASE + 13 // SHA1 over header only (hex)
-	SIG_LONGSIGSIZE     = SIG_BASE + 14 // header + compressed payload (uint64)
-	SIG_LONGARCHIVESIZE = SIG_BASE + 15 // uncompressed payload bytes (uint64)
-	SIG_SHA256          = SIG_BASE + 17 // SHA256 over header only (hex)
+	SIG_BASE                = 256
+	SIG_DSA                 = SIG_BASE + 11 // DSA signature over header only
+	SIG_RSA                 = SIG_BASE + 12 // RSA signature over header only
+	SIG_SHA1                = SIG_BASE + 13 // SHA1 over header only (hex)
+	SIG_LONGSIGSIZE         = SIG_BASE + 14 // header + compressed payload (uint64)
+	SIG_LONGARCHIVESIZE     = SIG_BASE + 15 // uncompressed payload bytes (uint64)
+	SIG_SHA256              = SIG_BASE + 17 // SHA256 over header only (hex)
+	SIG_FILESIGNATURES      = SIG_BASE + 18 // same as FILESIGNATURES
+	SIG_FILESIGNATURELENGTH = SIG_BASE + 19 // same as FILESIGNATURELENGTH
+	SIG_VERITYSIGNATURES    = SIG_BASE + 20 // fs-verity signature of each file (base64 PKCS#7)
+	SIG_VERITYSIGNATUREALGO = SIG_BASE + 21 // fs-verity hash algorithm of the signatures
+	SIG_OPENPGP             = SIG_BASE + 22 // OpenPGP signatures over header only (base64 array)
+	SIG_SHA3_256            = SIG_BASE + 23 // SHA3-256 over header only (hex)
 
 	// Given that there is overlap between signature tag headers and general tag
 	// headers, we offset the signature ones by some amount
@@ -205,6 +218,11 @@ const (
 	RPMVERIFY_RDEV       = 1 << 7
 	RPMVERIFY_CAPS       = 1 << 8
 	RPMVERIFY_CONTEXTS   = 1 << 15
+
+	// failures reported by VerifyTree, never found in FILEVERIFYFLAGS
+	RPMVERIFY_READLINKFAIL = 1 << 28
+	RPMVERIFY_READFAIL     = 1 << 29
+	RPMVERIFY_LSTATFAIL    = 1 << 30
 )
 
 // TRIGGERFLAGS bitmask elements -- not all rpmsenseFlags make sense in TRIGGERFLAGS
@@ -234,6 +252,11 @@ const (
 	RPMTAG_HEADERREGIONS    = 64
 )
 
+// Tags found in the gpg-pubkey pseudo-packages of a rpmdb
+const (
+	PUBKEYS = 266 // public keys, base64 or ASCII armored
+)
+
 // Crypto algos
 const (
 	HASH_MD5         = 1
@@ -246,4 +269,6 @@ const (
 	HASH_SHA384      = 9
 	HASH_SHA512      = 10
 	HASH_SHA224      = 11
+	HASH_SHA3_256    = 12
+	HASH_SHA3_512    = 14
 )
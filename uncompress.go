@@ -22,68 +22,221 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/ulikunitz/xz"
 	"github.com/ulikunitz/xz/lzma"
 )
 
+// DecompressorFactory wraps a compressed payload with a reader that
+// decompresses it. If the returned reader is also an io.Closer, it is closed
+// once the payload has been consumed.
+type DecompressorFactory func(r io.Reader) (io.Reader, error)
+
+type decompressor struct {
+	name    string
+	magic   []byte
+	factory DecompressorFactory
+	// parallel decompresses with multiple goroutines, if the format allows it
+	parallel func(r io.Reader, concurrency int) (io.Reader, error)
+	// checkpointed decompresses while reporting where decompression could
+	// later be resumed, and resume starts from one of those checkpoints
+	checkpointed func(r io.Reader, checkpoint checkpointFunc) (io.Reader, error)
+	resume       func(r io.Reader, state []byte) (io.Reader, error)
+}
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = []decompressor{
+		{
+			name:         "zstd",
+			magic:        []byte{0x28, 0xb5, 0x2f, 0xfd},
+			factory:      func(r io.Reader) (io.Reader, error) { return newZstdReader(r) },
+			parallel:     newParallelZstdReader,
+			checkpointed: newZstdIndexReader,
+			resume:       resumeZstdReader,
+		},
+		{
+			name:    "gzip",
+			magic:   []byte{0x1f, 0x8b},
+			factory: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			name:    "bzip2",
+			magic:   []byte("BZh"),
+			factory: func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+		},
+		// lzma has no real magic, but rpm always writes the same properties
+		{
+			name:    "lzma",
+			magic:   []byte{0x5d, 0x00, 0x00},
+			factory: func(r io.Reader) (io.Reader, error) { return lzma.NewReader(r) },
+		},
+		{
+			name:         "xz",
+			magic:        []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+			factory:      func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+			parallel:     newParallelXZReader,
+			checkpointed: newXZIndexReader,
+			resume:       resumeXZReader,
+		},
+		// prevent ExpandPayload from closing the underlying file
+		{
+			name:    "uncompressed",
+			magic:   []byte("0707"),
+			factory: func(r io.Reader) (io.Reader, error) { return noCloseWrapper{r}, nil },
+		},
+	}
+)
+
+// RegisterDecompressor adds a decompressor for payloads whose
+// PAYLOADCOMPRESSOR is name, or replaces the existing one. magic is the
+// signature that streams in this format start with, which is used to detect
+// the format when PAYLOADCOMPRESSOR is missing and to check it when it is
+// present. If magic is nil, the format is never detected or checked.
+//
+// When PayloadOptions.Concurrency is more than 1, the payload is decompressed
+// by factory in the background ahead of the reader. Replacing a built-in
+// format only replaces factory: its own parallel decompression and payload
+// indexing are kept, so indexes saved earlier remain usable.
+func RegisterDecompressor(name string, magic []byte, factory DecompressorFactory) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	d := decompressor{name: name, magic: append([]byte(nil), magic...), factory: factory}
+	for i, existing := range decompressors {
+		if existing.name == name {
+			d.parallel = existing.parallel
+			d.checkpointed = existing.checkpointed
+			d.resume = existing.resume
+			decompressors[i] = d
+			return
+		}
+	}
+	decompressors = append(decompressors, d)
+}
+
+// CompressorMismatchError is returned when the payload starts with the magic
+// of a different format than the one named by PAYLOADCOMPRESSOR. A payload
+// that matches no magic at all is left to the named format's decompressor.
+type CompressorMismatchError struct {
+	// Header is the format named by PAYLOADCOMPRESSOR
+	Header string
+	// Detected is the format detected from the payload
+	Detected string
+}
+
+func (e CompressorMismatchError) Error() string {
+	return fmt.Sprintf("payload compressor is %s but the payload is %s", e.Header, e.Detected)
+}
+
+// lookupDecompressor finds a decompressor by name, and the one whose magic
+// matches the start of the payload
+func lookupDecompressor(name string, start []byte) (named, detected *decompressor) {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	for i := range decompressors {
+		d := decompressors[i]
+		if d.name == name {
+			named = &d
+		}
+		if detected == nil && len(d.magic) != 0 && bytes.HasPrefix(start, d.magic) {
+			detected = &d
+		}
+	}
+	return
+}
+
+// peekLength returns the length of the longest registered magic
+func peekLength() int {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	var n int
+	for _, d := range decompressors {
+		if len(d.magic) > n {
+			n = len(d.magic)
+		}
+	}
+	return n
+}
+
 // Wrap RPM payload with uncompress reader, assumes that header has
 // already been read.
 func uncompressRpmPayloadReader(r io.Reader, hdr *RpmHeader) (io.Reader, error) {
+	return uncompressPayload(r, hdr, PayloadOptions{})
+}
+
+func uncompressPayload(r io.Reader, hdr *RpmHeader, opts PayloadOptions) (io.Reader, error) {
+	r, named, err := payloadDecompressor(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Concurrency <= 1 {
+		return named.factory(r)
+	} else if named.parallel != nil && opts.Limits == nil {
+		// parallel decoders buffer whole blocks or frames before the limits
+		// see any of them
+		return named.parallel(r, opts.Concurrency)
+	}
+	pld, err := named.factory(r)
+	if err != nil {
+		return nil, err
+	}
+	return newReadaheadReader(pld, opts.Concurrency), nil
+}
+
+// payloadDecompressor works out how the payload was compressed, returning the
+// decompressor and the payload with the bytes that were peeked at spliced back
+// in
+func payloadDecompressor(r io.Reader, hdr *RpmHeader) (io.Reader, *decompressor, error) {
 	// Check to make sure payload format is a cpio archive. If the tag does
 	// not exist, assume archive is cpio.
 	if hdr.HasTag(PAYLOADFORMAT) {
 		val, err := hdr.GetString(PAYLOADFORMAT)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if val != "cpio" {
-			return nil, fmt.Errorf("Unknown payload format %s", val)
+			return nil, nil, fmt.Errorf("Unknown payload format %s", val)
 		}
 	}
 
+	// peek at the start of the payload to detect the compression
+	start := make([]byte, peekLength())
+	n, err := io.ReadFull(r, start)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, err
+	}
+	start = start[:n]
+	// splice the peeked bytes back in
+	r = io.MultiReader(bytes.NewReader(start), r)
+
 	// Check to see how the payload was compressed. If the tag does not
-	// exist, check if it is gzip, if not it is uncompressed.
+	// exist, use the detected format, or assume it is uncompressed.
 	var compression string
 	if hdr.HasTag(PAYLOADCOMPRESSOR) {
 		val, err := hdr.GetString(PAYLOADCOMPRESSOR)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		compression = val
-	} else {
-		// peek at the start of the payload to see if it's compressed
-		b := make([]byte, 2)
-		_, err := io.ReadFull(r, b)
-		if err != nil {
-			return nil, err
-		}
-		if b[0] == 0x1f && b[1] == 0x8b {
-			compression = "gzip"
-		} else {
-			compression = "uncompressed"
-		}
-		// splice the peeked bytes back in
-		r = io.MultiReader(bytes.NewReader(b), r)
 	}
-
-	switch compression {
-	case "zstd":
-		return newZstdReader(r)
-	case "gzip":
-		return gzip.NewReader(r)
-	case "bzip2":
-		return bzip2.NewReader(r), nil
-	case "lzma":
-		return lzma.NewReader(r)
-	case "xz":
-		return xz.NewReader(r)
-	case "uncompressed":
-		// prevent ExpandPayload from closing the underlying file
-		return noCloseWrapper{r}, nil
-	default:
-		return nil, fmt.Errorf("Unknown compression type %s", compression)
+	named, detected := lookupDecompressor(compression, start)
+	switch {
+	case compression == "" && detected != nil:
+		named = detected
+	case compression == "":
+		named, _ = lookupDecompressor("uncompressed", nil)
+	case named == nil:
+		return nil, nil, fmt.Errorf("Unknown compression type %s", compression)
+	case len(named.magic) != 0 && !bytes.HasPrefix(start, named.magic) && detected != nil:
+		// only a payload that is recognizably something else is refused, as
+		// magics such as lzma's are not guaranteed
+		return nil, nil, CompressorMismatchError{Header: compression, Detected: detected.name}
+	}
+	if named == nil {
+		return nil, nil, fmt.Errorf("Unknown compression type %s", compression)
 	}
+	return r, named, nil
 }
 
 type noCloseWrapper struct {
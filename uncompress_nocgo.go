@@ -16,13 +16,3 @@ func newZstdReader(r io.Reader) (io.ReadCloser, error) {
 	}
 	return zstdCloser{Decoder: decoder}, nil
 }
-
-// wrap Decoder so it implements io.Closer properly
-type zstdCloser struct {
-	*zstd.Decoder
-}
-
-func (d zstdCloser) Close() error {
-	d.Decoder.Close()
-	return nil
-}
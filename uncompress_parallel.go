@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// PayloadOptions controls how the payload of a RPM is decompressed
+type PayloadOptions struct {
+	// Concurrency is the number of goroutines that may be used to decompress
+	// the payload. If it is 0 or 1, the payload is decompressed as it is read.
+	//
+	// Otherwise xz payloads with multiple blocks have their blocks decoded in
+	// parallel, and zstd payloads are decoded concurrently by the pure Go
+	// decoder. Other formats, and payloads written by single-threaded
+	// encoders, are decompressed in the background ahead of the reader. So
+	// are all payloads when Limits is set, so that no more than Concurrency
+	// chunks of 1 MiB are decompressed before the limits are checked.
+	Concurrency int
+	// VerifyDigests checks the payload against PAYLOADDIGEST, or SIG_MD5 for
+	// older packages, and against PAYLOADDIGESTALT as it is read. If it does
+	// not match, the final call to Next returns a PayloadDigestError instead
+	// of io.EOF. ExpandPayloadWithOptions returns the error once the files
+	// have been extracted, so they should be discarded.
+	VerifyDigests bool
+	// Limits, if set, stops reading the payload with a PayloadLimitError as
+	// soon as it exceeds one of the limits. The uncompressed size must also
+	// match SIG_PAYLOADSIZE or SIG_LONGARCHIVESIZE when the header has one.
+	Limits *PayloadLimits
+}
+
+// readaheadBlockSize is the size of the chunks decompressed in the background
+const readaheadBlockSize = 1 << 20
+
+type readaheadBlock struct {
+	data []byte
+	err  error
+}
+
+// readaheadReader decompresses ahead of the reader in another goroutine, the
+// same way as pgzip, so that decompression overlaps with whatever is done with
+// the decompressed data
+type readaheadReader struct {
+	src       io.Reader
+	blocks    chan readaheadBlock
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	cur       []byte
+	err       error
+}
+
+func newReadaheadReader(src io.Reader, concurrency int) *readaheadReader {
+	r := &readaheadReader{
+		src:    src,
+		blocks: make(chan readaheadBlock, concurrency),
+		done:   make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.fill()
+	return r
+}
+
+func (r *readaheadReader) fill() {
+	defer r.wg.Done()
+	defer close(r.blocks)
+	for {
+		buf := make([]byte, readaheadBlockSize)
+		n, err := io.ReadFull(r.src, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case r.blocks <- readaheadBlock{buf[:n], err}:
+		case <-r.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *readaheadReader) Read(d []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		block, ok := <-r.blocks
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		r.cur, r.err = block.data, block.err
+	}
+	n := copy(d, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops decompressing and closes the decompressor
+func (r *readaheadReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+		if c, ok := r.src.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+	return err
+}
+
+// newParallelZstdReader always uses the pure Go decoder, which unlike the cgo
+// one can decode concurrently
+func newParallelZstdReader(r io.Reader, concurrency int) (io.Reader, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(concurrency))
+	if err != nil {
+		return nil, err
+	}
+	return zstdCloser{Decoder: decoder}, nil
+}
+
+// wrap Decoder so it implements io.Closer properly
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (d zstdCloser) Close() error {
+	d.Decoder.Close()
+	return nil
+}
@@ -1,6 +1,10 @@
 package rpmutils
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -8,6 +12,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz/lzma"
 	"go.uber.org/goleak"
 )
 
@@ -54,3 +59,326 @@ func TestUncompressEmpty(t *testing.T) {
 	_, err = payload.Next()
 	assert.ErrorIs(t, err, io.EOF)
 }
+
+func TestDetectCompression(t *testing.T) {
+	for _, payloadType := range []string{"w3.zstdio", "w6.lzdio", "w6.xzdio", "w9.bzdio", "w9.gzdio", "w.ufdio"} {
+		t.Run(payloadType, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "payload-test-0.1-"+payloadType+".x86_64.rpm"))
+			require.NoError(t, err)
+			defer f.Close()
+			rpm, err := ReadRpm(f)
+			require.NoError(t, err)
+			delete(rpm.Header.genHeader.entries, PAYLOADCOMPRESSOR)
+			payload, err := rpm.PayloadReaderExtended()
+			require.NoError(t, err)
+			_, err = payload.Next()
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, payload)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCompressorMismatch(t *testing.T) {
+	f, err := os.Open("testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	rpm.Header.genHeader.setStrings(PAYLOADCOMPRESSOR, RPM_STRING_TYPE, []string{"xz"})
+	_, err = rpm.PayloadReaderExtended()
+	assert.Equal(t, CompressorMismatchError{Header: "xz", Detected: "gzip"}, err)
+
+	// lzma streams with other properties don't match rpm's usual magic, but
+	// are still decompressed as lzma when the header says so
+	blob, err := os.ReadFile("testdata/payload-test-0.1-w6.lzdio.x86_64.rpm")
+	require.NoError(t, err)
+	hdr, err := ReadHeader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	payloadStart := hdr.GetRange().End
+	require.Equal(t, []byte{0x5d, 0, 0}, blob[payloadStart:payloadStart+3])
+	// a dictionary one byte larger
+	blob[payloadStart+1] = 1
+	rpm, err = ReadRpm(bytes.NewReader(blob))
+	require.NoError(t, err)
+	payload, err := rpm.PayloadReaderExtended()
+	require.NoError(t, err)
+	_, err = payload.Next()
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, payload)
+	require.NoError(t, err)
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	orig, _ := lookupDecompressor("xz", nil)
+	t.Cleanup(func() { RegisterDecompressor(orig.name, orig.magic, orig.factory) })
+	var calls int
+	RegisterDecompressor("xz", xzMagic, func(r io.Reader) (io.Reader, error) {
+		calls++
+		return orig.factory(r)
+	})
+	f, err := os.Open("testdata/payload-test-0.1-w6.xzdio.x86_64.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	require.NoError(t, rpm.ExpandPayload(t.TempDir()))
+	assert.Equal(t, 1, calls)
+	// parallel decompression and payload indexes still work
+	replaced, _ := lookupDecompressor("xz", nil)
+	assert.NotNil(t, replaced.parallel)
+	assert.NotNil(t, replaced.checkpointed)
+	assert.NotNil(t, replaced.resume)
+}
+
+func TestParallelXZ(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	// built with: xz -T4 --block-size=65536, then a stream from xz -T1
+	var expected bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&expected, "line %d\n", i)
+	}
+	blob, err := os.ReadFile("testdata/multiblock.xz")
+	require.NoError(t, err)
+	r, err := newParallelXZReader(bytes.NewReader(blob), 4)
+	require.NoError(t, err)
+	require.IsType(t, &parallelXZReader{}, r)
+	actual, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Bytes(), actual)
+	require.NoError(t, r.(io.Closer).Close())
+
+	// corrupt the middle of the first stream
+	blob[len(blob)/4] ^= 0xff
+	r, err = newParallelXZReader(bytes.NewReader(blob), 4)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+	require.NoError(t, r.(io.Closer).Close())
+
+	// close without reading to the end
+	r, err = newParallelXZReader(bytes.NewReader(blob), 2)
+	require.NoError(t, err)
+	_, err = r.Read(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, r.(io.Closer).Close())
+}
+
+// makeXZ builds a xz stream with a block for each chunk, recording the sizes
+// in the block headers as the multi-threaded encoder in liblzma does. If
+// declare is set, it returns the uncompressed size to record for each block.
+func makeXZ(t testing.TB, chunks [][]byte, declare func(actual int64) int64) []byte {
+	varint := func(buf *bytes.Buffer, v int64) {
+		for v >= 0x80 {
+			buf.WriteByte(byte(v) | 0x80)
+			v >>= 7
+		}
+		buf.WriteByte(byte(v))
+	}
+	var out, index bytes.Buffer
+	flags := []byte{0, 1}
+	out.Write(xzMagic)
+	out.Write(flags)
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(flags))
+	index.WriteByte(0)
+	varint(&index, int64(len(chunks)))
+	for _, chunk := range chunks {
+		var compressed bytes.Buffer
+		w, err := lzma.Writer2Config{DictCap: 8 << 20}.NewWriter2(&compressed)
+		require.NoError(t, err)
+		_, err = w.Write(chunk)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		uncompressed := int64(len(chunk))
+		if declare != nil {
+			uncompressed = declare(uncompressed)
+		}
+		var header bytes.Buffer
+		header.Write([]byte{0, 0xc0})
+		varint(&header, int64(compressed.Len()))
+		varint(&header, uncompressed)
+		// LZMA2 with an 8 MiB dictionary
+		header.Write([]byte{xzFilterLZMA2, 1, 22})
+		for (header.Len()+4)%4 != 0 {
+			header.WriteByte(0)
+		}
+		h := header.Bytes()
+		h[0] = byte((len(h)+4)/4 - 1)
+		out.Write(h)
+		binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(h))
+		out.Write(compressed.Bytes())
+		out.Write(make([]byte, (-compressed.Len())&3))
+		binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(chunk))
+		varint(&index, int64(len(h)+4+compressed.Len()+4))
+		varint(&index, int64(len(chunk)))
+	}
+	index.Write(make([]byte, (-index.Len())&3))
+	binary.Write(&index, binary.LittleEndian, crc32.ChecksumIEEE(index.Bytes()))
+	out.Write(index.Bytes())
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(index.Len()/4-1))
+	footer = append(footer, flags...)
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(footer))
+	out.Write(footer)
+	out.Write(xzFooterMagic)
+	return out.Bytes()
+}
+
+func TestParallelXZBlockSizes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	chunk := func(n int) []byte {
+		var buf bytes.Buffer
+		for i := 0; buf.Len() < n; i++ {
+			fmt.Fprintf(&buf, "line %d\n", i)
+		}
+		return buf.Bytes()[:n]
+	}
+	readAll := func(blob []byte) ([]byte, error) {
+		r, err := newParallelXZReader(bytes.NewReader(blob), 4)
+		require.NoError(t, err)
+		defer r.(io.Closer).Close()
+		return io.ReadAll(r)
+	}
+	// lower the limit to keep the blocks small
+	defer func(orig int64) { xzMaxParallelBlock = orig }(xzMaxParallelBlock)
+	xzMaxParallelBlock = 1 << 20
+	// a block above the limit is streamed between the parallel ones
+	large := chunk(int(xzMaxParallelBlock) + 1)
+	chunks := [][]byte{chunk(1 << 16), large, chunk(1 << 16)}
+	blob := makeXZ(t, chunks, nil)
+	actual, err := readAll(blob)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Join(chunks, nil), actual)
+
+	// blocks that decode to more than they declare are stopped
+	chunks = [][]byte{chunk(1 << 16), chunk(1 << 16)}
+	_, err = readAll(makeXZ(t, chunks, func(actual int64) int64 { return actual / 2 }))
+	assert.EqualError(t, err, "xz: block uncompressed size mismatch")
+	// even when streamed
+	_, err = readAll(makeXZ(t, [][]byte{chunk(1 << 16), large}, func(actual int64) int64 { return actual - 1 }))
+	assert.EqualError(t, err, "xz: block uncompressed size mismatch")
+	// and blocks that declare too much are caught too
+	_, err = readAll(makeXZ(t, chunks, func(actual int64) int64 { return actual + 1 }))
+	assert.EqualError(t, err, "xz: block uncompressed size mismatch")
+
+	// the first block decides whether to decode in parallel at all
+	r, err := newParallelXZReader(bytes.NewReader(makeXZ(t, [][]byte{large}, nil)), 4)
+	require.NoError(t, err)
+	assert.IsType(t, &readaheadReader{}, r)
+	require.NoError(t, r.(io.Closer).Close())
+}
+
+func TestPayloadConcurrency(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	readAll := func(t *testing.T, blob []byte, concurrency int) map[string][]byte {
+		rpm, err := ReadRpm(bytes.NewReader(blob))
+		require.NoError(t, err)
+		payload, err := rpm.PayloadReaderWithOptions(PayloadOptions{Concurrency: concurrency})
+		require.NoError(t, err)
+		contents := make(map[string][]byte)
+		for {
+			info, err := payload.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			contents[info.Name()], err = io.ReadAll(payload)
+			require.NoError(t, err)
+		}
+		return contents
+	}
+	for _, payloadType := range []string{"w3.zstdio", "w6.lzdio", "w6.xzdio", "w9.bzdio", "w9.gzdio", "w.ufdio"} {
+		t.Run(payloadType, func(t *testing.T) {
+			blob, err := os.ReadFile(filepath.Join("testdata", "payload-test-0.1-"+payloadType+".x86_64.rpm"))
+			require.NoError(t, err)
+			expected := readAll(t, blob, 1)
+			require.Len(t, expected, 1)
+			assert.Equal(t, expected, readAll(t, blob, 4))
+		})
+	}
+	t.Run("w6T4.xzdio", func(t *testing.T) {
+		// the same payload recompressed with: xz -T4 --block-size=64
+		blob, err := os.ReadFile("testdata/payload-test-0.1-w6.xzdio.x86_64.rpm")
+		require.NoError(t, err)
+		expected := readAll(t, blob, 1)
+		hdr, err := ReadHeader(bytes.NewReader(blob))
+		require.NoError(t, err)
+		payload, err := os.ReadFile("testdata/payload-test.cpio.xz")
+		require.NoError(t, err)
+		blob = append(blob[:hdr.GetRange().End:hdr.GetRange().End], payload...)
+		assert.Equal(t, expected, readAll(t, blob, 1))
+		assert.Equal(t, expected, readAll(t, blob, 4))
+	})
+}
+
+func BenchmarkPayload(b *testing.B) {
+	for _, payloadType := range []string{"w3.zstdio", "w6.lzdio", "w6.xzdio", "w9.bzdio", "w9.gzdio", "w.ufdio"} {
+		blob, err := os.ReadFile(filepath.Join("testdata", "payload-test-0.1-"+payloadType+".x86_64.rpm"))
+		require.NoError(b, err)
+		for _, concurrency := range []int{1, 4} {
+			b.Run(fmt.Sprintf("%s/%d", payloadType, concurrency), func(b *testing.B) {
+				b.SetBytes(int64(len(blob)))
+				for i := 0; i < b.N; i++ {
+					rpm, err := ReadRpm(bytes.NewReader(blob))
+					require.NoError(b, err)
+					payload, err := rpm.PayloadReaderWithOptions(PayloadOptions{Concurrency: concurrency})
+					require.NoError(b, err)
+					for {
+						_, err := payload.Next()
+						if err == io.EOF {
+							break
+						}
+						require.NoError(b, err)
+						_, err = io.Copy(io.Discard, payload)
+						require.NoError(b, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPayloadCompression(t *testing.T) {
+	for _, payloadType := range []string{"w3.zstdio", "w6.lzdio", "w6.xzdio", "w9.bzdio", "w9.gzdio", "w.ufdio"} {
+		t.Run(payloadType, func(t *testing.T) {
+			fp := filepath.Join("testdata", "payload-test-0.1-"+payloadType+".x86_64.rpm")
+			st, err := os.Stat(fp)
+			require.NoError(t, err)
+			f, err := os.Open(fp)
+			require.NoError(t, err)
+			defer f.Close()
+			hdr, err := ReadHeader(f)
+			require.NoError(t, err)
+			c, err := hdr.PayloadCompression()
+			require.NoError(t, err)
+			assert.Equal(t, payloadType, c.String())
+			size, err := hdr.CompressedPayloadSize()
+			require.NoError(t, err)
+			assert.Equal(t, st.Size()-int64(hdr.GetRange().End), size)
+		})
+	}
+}
+
+func TestParsePayloadFlags(t *testing.T) {
+	for flags, expected := range map[string]PayloadCompression{
+		"9":           {Level: 9, Threads: -1},
+		"w19T8":       {Level: 19, Threads: 8},
+		"19.zstdio":   {Compressor: "zstd", Level: 19, Threads: -1},
+		"w7T.xzdio":   {Compressor: "xz", Level: 7, Threads: 0},
+		"w19T16L27":   {Level: 19, Threads: 16, WindowLog: 27},
+		"":            {Level: -1, Threads: -1},
+		"w.ufdio":     {Compressor: "uncompressed", Level: -1, Threads: -1},
+		"w6.lzdio":    {Compressor: "lzma", Level: 6, Threads: -1},
+		"w9.bzdio":    {Compressor: "bzip2", Level: 9, Threads: -1},
+		"w9.gzdio":    {Compressor: "gzip", Level: 9, Threads: -1},
+		"w3T0.zstdio": {Compressor: "zstd", Level: 3, Threads: 0},
+	} {
+		expected.Flags = flags
+		c, err := ParsePayloadFlags(flags)
+		require.NoError(t, err, flags)
+		assert.Equal(t, expected, c, flags)
+	}
+	for _, flags := range []string{"w9.foo", "w9X", "w19L"} {
+		_, err := ParsePayloadFlags(flags)
+		assert.Error(t, err, flags)
+	}
+}
@@ -0,0 +1,740 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// The multi-threaded encoder in liblzma, which rpm uses for payloads like
+// w19T8.xzdio, splits the stream into independent blocks and records their
+// compressed sizes in the block headers. That allows the blocks to be cut out
+// of the stream and decoded in parallel. Streams from the single-threaded
+// encoder have one block without sizes, and are decoded as usual.
+//
+// The sizes come from the untrusted payload, so a block is only decoded in
+// parallel if both of them are recorded and neither is above
+// xzMaxParallelBlock. Other blocks are streamed as they are decoded.
+
+const xzFilterLZMA2 = 0x21
+
+var (
+	// xzMaxParallelBlock is the largest block buffered for a worker, and the
+	// largest output a worker may buffer
+	xzMaxParallelBlock int64 = 32 << 20
+
+	xzMagic       = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+	crc64Table    = crc64.MakeTable(crc64.ECMA)
+
+	errXZUnsupported = errors.New("xz: unsupported filter chain for parallel decoding")
+)
+
+// newParallelXZReader decodes a xz stream with up to concurrency goroutines
+func newParallelXZReader(r io.Reader, concurrency int) (io.Reader, error) {
+	br := newPosReader(r)
+	if !xzParallelizable(br.br) {
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return newReadaheadReader(xr, concurrency), nil
+	}
+	return startXZReader(br, concurrency, -1, nil), nil
+}
+
+// newXZIndexReader decodes a xz stream, reporting a checkpoint at each block.
+// If the first block does not record its sizes or is too large to buffer, the
+// stream is decoded as it is read without any checkpoints.
+func newXZIndexReader(r io.Reader, checkpoint checkpointFunc) (io.Reader, error) {
+	br := newPosReader(r)
+	if !xzParallelizable(br.br) {
+		return xz.NewReader(br)
+	}
+	return startXZReader(br, 1, -1, checkpoint), nil
+}
+
+// resumeXZReader decodes a xz stream starting at a block, where state holds
+// the check type of the stream
+func resumeXZReader(r io.Reader, state []byte) (io.Reader, error) {
+	if len(state) != 1 {
+		return nil, errors.New("xz: invalid checkpoint")
+	}
+	return startXZReader(newPosReader(r), 1, int(state[0]), nil), nil
+}
+
+// startXZReader starts decoding blocks with concurrency workers. If resume is
+// not -1, br is positioned at a block of a stream with that check type, instead
+// of at the start of a stream. checkpoint, if set, is called as each block is
+// reached.
+func startXZReader(br *posReader, concurrency int, resume int, checkpoint checkpointFunc) *parallelXZReader {
+	x := &parallelXZReader{
+		order:      make(chan *xzJob, concurrency),
+		done:       make(chan struct{}),
+		resume:     resume,
+		checkpoint: checkpoint,
+	}
+	jobs := make(chan *xzJob)
+	x.wg.Add(1 + concurrency)
+	go x.produce(br, jobs)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer x.wg.Done()
+			for job := range jobs {
+				job.decode()
+			}
+		}()
+	}
+	return x
+}
+
+// xzParallelizable checks whether the first block of the stream can be decoded
+// by a worker of parallelXZReader
+func xzParallelizable(br *bufio.Reader) bool {
+	start, _ := br.Peek(13)
+	if len(start) < 13 || !bytes.Equal(start[:6], xzMagic) || start[12] == 0 {
+		return false
+	}
+	header, err := br.Peek(12 + (int(start[12])+1)*4)
+	if err != nil {
+		return false
+	}
+	info, err := parseXZBlockHeader(header[12:])
+	if err != nil {
+		return false
+	}
+	return info.parallel()
+}
+
+// xzBlockHeader holds the fields of a block header that the decoder needs
+type xzBlockHeader struct {
+	size             int
+	compressedSize   int64
+	uncompressedSize int64
+	dictCap          int
+}
+
+// parallel returns true if the block is small enough to be buffered and
+// decoded by a worker
+func (info xzBlockHeader) parallel() bool {
+	return info.compressedSize >= 0 && info.compressedSize <= xzMaxParallelBlock &&
+		info.uncompressedSize >= 0 && info.uncompressedSize <= xzMaxParallelBlock
+}
+
+func parseXZBlockHeader(header []byte) (xzBlockHeader, error) {
+	info := xzBlockHeader{size: len(header), compressedSize: -1, uncompressedSize: -1}
+	n := len(header)
+	if n < 8 || n != (int(header[0])+1)*4 {
+		return info, errors.New("xz: invalid block header size")
+	}
+	if crc32.ChecksumIEEE(header[:n-4]) != binary.LittleEndian.Uint32(header[n-4:]) {
+		return info, errors.New("xz: block header checksum mismatch")
+	}
+	flags := header[1]
+	if flags&0x3c != 0 {
+		return info, errors.New("xz: unsupported block flags")
+	}
+	r := bytes.NewReader(header[2 : n-4])
+	if flags&0x40 != 0 {
+		v, err := readXZVarint(r)
+		if err != nil || v == 0 || v > 1<<62 {
+			return info, errors.New("xz: invalid compressed size")
+		}
+		info.compressedSize = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, err := readXZVarint(r)
+		if err != nil || v > 1<<62 {
+			return info, errors.New("xz: invalid uncompressed size")
+		}
+		info.uncompressedSize = int64(v)
+	}
+	// rpm only uses LZMA2 without any branch filters
+	if flags&3 != 0 {
+		return info, errXZUnsupported
+	}
+	id, err := readXZVarint(r)
+	if err != nil {
+		return info, err
+	}
+	propsSize, err := readXZVarint(r)
+	if err != nil {
+		return info, err
+	}
+	if id != xzFilterLZMA2 || propsSize != 1 {
+		return info, errXZUnsupported
+	}
+	props, err := r.ReadByte()
+	if err != nil {
+		return info, err
+	}
+	bits := props & 0x3f
+	if bits > 40 {
+		return info, errors.New("xz: invalid LZMA2 dictionary size")
+	}
+	dictCap := int64(lzma.MaxDictCap)
+	if bits < 40 {
+		dictCap = (2 | int64(bits&1)) << (bits/2 + 11)
+	}
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+	info.dictCap = int(dictCap)
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return info, errors.New("xz: invalid block header padding")
+		}
+	}
+	return info, nil
+}
+
+// readXZVarint reads a xz multibyte integer
+func readXZVarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i > 0 && b == 0 {
+			return 0, errors.New("xz: invalid integer")
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("xz: invalid integer")
+}
+
+// xzCheckSize returns the size of the check field for a check type
+func xzCheckSize(id byte) int {
+	if id == 0 {
+		return 0
+	}
+	return 4 << ((id - 1) / 3)
+}
+
+// xzChecker calculates the check field of a block as it is decoded
+type xzChecker struct {
+	h hash.Hash
+}
+
+func newXZChecker(id byte) *xzChecker {
+	switch id {
+	case 0x01:
+		return &xzChecker{crc32.NewIEEE()}
+	case 0x04:
+		return &xzChecker{crc64.New(crc64Table)}
+	case 0x0a:
+		return &xzChecker{sha256.New()}
+	default:
+		return &xzChecker{}
+	}
+}
+
+func (c *xzChecker) Write(d []byte) (int, error) {
+	if c.h != nil {
+		c.h.Write(d)
+	}
+	return len(d), nil
+}
+
+// sum returns the check field, or nil if the check type is not supported
+func (c *xzChecker) sum() []byte {
+	switch h := c.h.(type) {
+	case nil:
+		return nil
+	case hash.Hash32:
+		return binary.LittleEndian.AppendUint32(nil, h.Sum32())
+	case hash.Hash64:
+		return binary.LittleEndian.AppendUint64(nil, h.Sum64())
+	default:
+		return h.Sum(nil)
+	}
+}
+
+// xzJob is a block that is decoded by a worker, or streamed to the reader if
+// stream is set
+type xzJob struct {
+	offset  int64
+	info    xzBlockHeader
+	checkID byte
+	data    []byte
+	check   []byte
+	done    chan struct{}
+	out     []byte
+	stream  *xzBlockStream
+	err     error
+}
+
+func (j *xzJob) decode() {
+	defer close(j.done)
+	j.out, j.err = decodeXZBlock(bytes.NewReader(j.data), j.info)
+	if j.err == nil {
+		j.err = j.verify()
+	}
+}
+
+func (j *xzJob) verify() error {
+	if int64(len(j.out)) != j.info.uncompressedSize {
+		return errXZSizeMismatch
+	}
+	c := newXZChecker(j.checkID)
+	c.Write(j.out)
+	if sum := c.sum(); sum != nil && !bytes.Equal(sum, j.check) {
+		return errXZCheckMismatch
+	}
+	return nil
+}
+
+var (
+	errXZSizeMismatch  = errors.New("xz: block uncompressed size mismatch")
+	errXZCheckMismatch = errors.New("xz: block checksum mismatch")
+)
+
+// decodeXZBlock decodes a block whose uncompressed size is known, stopping as
+// soon as it produces more than that
+func decodeXZBlock(r io.Reader, info xzBlockHeader) ([]byte, error) {
+	lr, err := lzma.Reader2Config{DictCap: info.dictCap}.NewReader2(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, info.uncompressedSize))
+	if _, err := io.Copy(buf, io.LimitReader(lr, info.uncompressedSize+1)); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > info.uncompressedSize {
+		return nil, errXZSizeMismatch
+	}
+	if !lr.EOS() {
+		return nil, errors.New("xz: block is missing end of stream marker")
+	}
+	return buf.Bytes(), nil
+}
+
+// xzBlockStream decodes a block that is too large, or whose size is not known,
+// as it is read. The rest of the stream can only be read once it is finished.
+type xzBlockStream struct {
+	br       *posReader
+	cr       *countingReader
+	lr       *lzma.Reader2
+	info     xzBlockHeader
+	checkID  byte
+	checker  *xzChecker
+	n        int64
+	finished chan struct{}
+	err      error
+}
+
+func newXZBlockStream(br *posReader, info xzBlockHeader, checkID byte) (*xzBlockStream, error) {
+	s := &xzBlockStream{
+		br:       br,
+		cr:       &countingReader{r: br},
+		info:     info,
+		checkID:  checkID,
+		checker:  newXZChecker(checkID),
+		finished: make(chan struct{}),
+	}
+	var src io.Reader = s.cr
+	if info.compressedSize >= 0 {
+		src = io.LimitReader(s.cr, info.compressedSize)
+	}
+	var err error
+	s.lr, err = lzma.Reader2Config{DictCap: info.dictCap}.NewReader2(src)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *xzBlockStream) Read(d []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.lr.Read(d)
+	s.n += int64(n)
+	if s.info.uncompressedSize >= 0 && s.n > s.info.uncompressedSize {
+		n, err = 0, errXZSizeMismatch
+	}
+	s.checker.Write(d[:n])
+	if err == io.EOF {
+		err = s.finish()
+	}
+	if err != nil {
+		s.err = err
+		close(s.finished)
+	}
+	return n, err
+}
+
+// finish reads and checks the end of the block, returning io.EOF if it is
+// intact
+func (s *xzBlockStream) finish() error {
+	if !s.lr.EOS() {
+		return errors.New("xz: block is missing end of stream marker")
+	} else if s.info.compressedSize >= 0 && s.cr.n != s.info.compressedSize {
+		return errors.New("xz: block compressed size mismatch")
+	} else if s.info.uncompressedSize >= 0 && s.n != s.info.uncompressedSize {
+		return errXZSizeMismatch
+	}
+	checkSize := xzCheckSize(s.checkID)
+	trailer := make([]byte, int((-s.cr.n)&3)+checkSize)
+	if _, err := io.ReadFull(s.br, trailer); err != nil {
+		return noEOF(err)
+	}
+	if !allZero(trailer[:len(trailer)-checkSize]) {
+		return errors.New("xz: invalid block padding")
+	}
+	if sum := s.checker.sum(); sum != nil && !bytes.Equal(sum, trailer[len(trailer)-checkSize:]) {
+		return errXZCheckMismatch
+	}
+	return io.EOF
+}
+
+// parallelXZReader returns the decoded blocks of a xz stream in order
+type parallelXZReader struct {
+	order      chan *xzJob
+	done       chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+	resume     int
+	checkpoint checkpointFunc
+	delivered  int64
+	buf        []byte
+	stream     *xzBlockStream
+	err        error
+}
+
+func (x *parallelXZReader) Read(d []byte) (int, error) {
+	for len(x.buf) == 0 {
+		if x.stream != nil {
+			n, err := x.stream.Read(d)
+			x.delivered += int64(n)
+			if err == io.EOF {
+				x.stream = nil
+			} else if err != nil {
+				x.stream = nil
+				x.err = err
+			}
+			if n > 0 || x.err != nil {
+				return n, x.err
+			}
+			continue
+		}
+		if x.err != nil {
+			return 0, x.err
+		}
+		job, ok := <-x.order
+		if !ok {
+			x.err = io.EOF
+			continue
+		}
+		<-job.done
+		x.buf, x.stream, x.err = job.out, job.stream, job.err
+		if x.err == nil && x.checkpoint != nil {
+			x.checkpoint(job.offset, x.delivered, []byte{job.checkID})
+		}
+	}
+	n := copy(d, x.buf)
+	x.buf = x.buf[n:]
+	x.delivered += int64(n)
+	return n, nil
+}
+
+// Close stops decoding and waits for the workers to exit
+func (x *parallelXZReader) Close() error {
+	x.closeOnce.Do(func() {
+		close(x.done)
+		x.wg.Wait()
+	})
+	return nil
+}
+
+// produce splits the stream into blocks and dispatches them to the workers
+func (x *parallelXZReader) produce(br *posReader, jobs chan<- *xzJob) {
+	defer x.wg.Done()
+	defer close(jobs)
+	defer close(x.order)
+	if err := x.readStreams(br, jobs); err != nil {
+		job := &xzJob{done: make(chan struct{}), err: err}
+		close(job.done)
+		x.send(job, nil)
+	}
+}
+
+// send queues a job to be returned in order, and to be decoded if jobs is not
+// nil
+func (x *parallelXZReader) send(job *xzJob, jobs chan<- *xzJob) bool {
+	select {
+	case x.order <- job:
+	case <-x.done:
+		return false
+	}
+	if jobs == nil {
+		return true
+	}
+	select {
+	case jobs <- job:
+		return true
+	case <-x.done:
+		return false
+	}
+}
+
+var errXZClosed = errors.New("xz: reader closed")
+
+// readStreams reads concatenated streams and the padding between them
+func (x *parallelXZReader) readStreams(br *posReader, jobs chan<- *xzJob) error {
+	for first := true; ; first = false {
+		if !first {
+			b, err := br.Peek(4)
+			if len(b) == 0 && err == io.EOF {
+				return nil
+			} else if len(b) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			if bytes.Equal(b, []byte{0, 0, 0, 0}) {
+				br.Discard(4)
+				continue
+			}
+		}
+		resume := -1
+		if first {
+			resume = x.resume
+		}
+		if err := x.readStream(br, jobs, resume); err == errXZClosed {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+type xzRecord struct {
+	unpaddedSize     int64
+	uncompressedSize int64
+}
+
+// readStream reads a stream, or the rest of one starting at a block if resume
+// is not -1
+func (x *parallelXZReader) readStream(br *posReader, jobs chan<- *xzJob, resume int) error {
+	flags := []byte{0, byte(resume)}
+	if resume < 0 {
+		var header [12]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return err
+		}
+		if !bytes.Equal(header[:6], xzMagic) {
+			return errors.New("xz: invalid stream header")
+		}
+		flags = header[6:8]
+		if crc32.ChecksumIEEE(flags) != binary.LittleEndian.Uint32(header[8:]) {
+			return errors.New("xz: stream header checksum mismatch")
+		}
+	}
+	if flags[0] != 0 || flags[1]&0xf0 != 0 {
+		return errors.New("xz: unsupported stream flags")
+	}
+	checkID := flags[1]
+	var records []xzRecord
+	for {
+		offset := br.pos
+		b, err := br.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		if b == 0 {
+			break
+		}
+		rec, err := x.readBlock(br, offset, b, checkID, jobs)
+		if err != nil {
+			return err
+		}
+		records = append(records, rec)
+	}
+	// the blocks before the resumed one are not known
+	indexSize, err := readXZIndex(br, records, resume < 0)
+	if err != nil {
+		return err
+	}
+	var footer [12]byte
+	if _, err := io.ReadFull(br, footer[:]); err != nil {
+		return noEOF(err)
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) ||
+		!bytes.Equal(footer[10:], xzFooterMagic) ||
+		!bytes.Equal(footer[8:10], flags) ||
+		(int64(binary.LittleEndian.Uint32(footer[4:]))+1)*4 != indexSize {
+		return errors.New("xz: invalid stream footer")
+	}
+	return nil
+}
+
+// readBlock reads a block and hands it to the workers, or streams it to the
+// reader if it is too large or its sizes are not known
+func (x *parallelXZReader) readBlock(br *posReader, offset int64, sizeByte byte, checkID byte, jobs chan<- *xzJob) (xzRecord, error) {
+	header := make([]byte, (int(sizeByte)+1)*4)
+	header[0] = sizeByte
+	if _, err := io.ReadFull(br, header[1:]); err != nil {
+		return xzRecord{}, noEOF(err)
+	}
+	info, err := parseXZBlockHeader(header)
+	if err != nil {
+		return xzRecord{}, err
+	}
+	job := &xzJob{offset: offset, info: info, checkID: checkID, done: make(chan struct{})}
+	checkSize := xzCheckSize(checkID)
+	if info.parallel() {
+		padded := (info.compressedSize + 3) &^ 3
+		buf := make([]byte, padded+int64(checkSize))
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return xzRecord{}, noEOF(err)
+		}
+		if !allZero(buf[info.compressedSize:padded]) {
+			return xzRecord{}, errors.New("xz: invalid block padding")
+		}
+		job.data = buf[:info.compressedSize]
+		job.check = buf[padded:]
+		if !x.send(job, jobs) {
+			return xzRecord{}, errXZClosed
+		}
+		return xzRecord{int64(info.size) + info.compressedSize + int64(checkSize), info.uncompressedSize}, nil
+	}
+	// the reader decodes the block from br, so wait for it to finish
+	job.stream, err = newXZBlockStream(br, info, checkID)
+	if err != nil {
+		return xzRecord{}, err
+	}
+	close(job.done)
+	if !x.send(job, nil) {
+		return xzRecord{}, errXZClosed
+	}
+	select {
+	case <-job.stream.finished:
+	case <-x.done:
+		return xzRecord{}, errXZClosed
+	}
+	if job.stream.err != io.EOF {
+		// the reader has already returned the error
+		return xzRecord{}, errXZClosed
+	}
+	return xzRecord{int64(info.size) + job.stream.cr.n + int64(checkSize), job.stream.n}, nil
+}
+
+// readXZIndex reads the index after the index indicator and, if validate is
+// set, checks it against the blocks that were read. It returns the size of the
+// index.
+func readXZIndex(br *posReader, records []xzRecord, validate bool) (int64, error) {
+	ir := &xzIndexReader{br: br, h: crc32.NewIEEE(), n: 1}
+	ir.h.Write([]byte{0})
+	count, err := readXZVarint(ir)
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	if validate && count != uint64(len(records)) {
+		return 0, errors.New("xz: index does not match the blocks")
+	}
+	for i := uint64(0); i < count; i++ {
+		unpadded, err := readXZVarint(ir)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		uncompressed, err := readXZVarint(ir)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		if !validate {
+			continue
+		}
+		rec := records[i]
+		if int64(unpadded) != rec.unpaddedSize || (rec.uncompressedSize >= 0 && int64(uncompressed) != rec.uncompressedSize) {
+			return 0, errors.New("xz: index does not match the blocks")
+		}
+	}
+	for ir.n%4 != 0 {
+		if b, err := ir.ReadByte(); err != nil {
+			return 0, noEOF(err)
+		} else if b != 0 {
+			return 0, errors.New("xz: invalid index padding")
+		}
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return 0, noEOF(err)
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != ir.h.Sum32() {
+		return 0, errors.New("xz: index checksum mismatch")
+	}
+	return ir.n + 4, nil
+}
+
+// xzIndexReader checksums and counts the bytes of the index as they are read
+type xzIndexReader struct {
+	br io.ByteReader
+	h  hash.Hash32
+	n  int64
+}
+
+func (r *xzIndexReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+		r.n++
+	}
+	return b, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(d []byte) (int, error) {
+	n, err := c.r.Read(d)
+	c.n += int64(n)
+	return n, err
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// noEOF turns a clean EOF in the middle of a stream into an unexpected one
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) SAS Institute, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zstdFrameMagic     = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+)
+
+// zstdIndexReader decodes a zstd stream one frame at a time, reporting a
+// checkpoint at the start of each frame. Every frame can be decoded on its
+// own, so decoding can later resume from any of them.
+type zstdIndexReader struct {
+	br         *posReader
+	dec        *zstd.Decoder
+	checkpoint checkpointFunc
+	frame      *zstdFrameReader
+	produced   int64
+	err        error
+}
+
+func newZstdIndexReader(r io.Reader, checkpoint checkpointFunc) (io.Reader, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdIndexReader{br: newPosReader(r), dec: dec, checkpoint: checkpoint}, nil
+}
+
+// resumeZstdReader decodes from the start of a frame. The pure Go decoder is
+// always used, as the cgo one fails on some streams of several frames.
+func resumeZstdReader(r io.Reader, state []byte) (io.Reader, error) {
+	return newParallelZstdReader(r, 1)
+}
+
+func (z *zstdIndexReader) Read(d []byte) (int, error) {
+	for z.err == nil {
+		if z.frame == nil {
+			z.err = z.nextFrame()
+			continue
+		}
+		n, err := z.dec.Read(d)
+		z.produced += int64(n)
+		if err == io.EOF {
+			z.frame = nil
+			err = nil
+		}
+		z.err = err
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, z.err
+}
+
+// nextFrame skips skippable frames and starts decoding the next frame
+func (z *zstdIndexReader) nextFrame() error {
+	for {
+		b, err := z.br.Peek(8)
+		if len(b) == 0 && err == io.EOF {
+			return io.EOF
+		} else if len(b) < 4 {
+			return io.ErrUnexpectedEOF
+		}
+		magic := binary.LittleEndian.Uint32(b)
+		switch {
+		case magic == zstdFrameMagic:
+			z.checkpoint(z.br.pos, z.produced, nil)
+			z.frame = &zstdFrameReader{br: z.br}
+			return z.dec.Reset(z.frame)
+		case magic&^0xf == zstdSkippableMagic:
+			if len(b) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			size := int64(binary.LittleEndian.Uint32(b[4:]))
+			if _, err := io.CopyN(io.Discard, z.br, 8+size); err != nil {
+				return noEOF(err)
+			}
+		default:
+			return errors.New("zstd: invalid frame magic")
+		}
+	}
+}
+
+func (z *zstdIndexReader) Close() error {
+	z.dec.Close()
+	return nil
+}
+
+const (
+	zstdStageHeader = iota
+	zstdStageBlock
+	zstdStageChecksum
+	zstdStageDone
+)
+
+// zstdFrameReader passes through exactly one frame, parsing just enough of its
+// structure to find where it ends
+type zstdFrameReader struct {
+	br       *posReader
+	stage    int
+	checksum bool
+	// buf holds parsed headers to pass on, and n is the number of bytes of
+	// the current block or checksum that follow them
+	buf []byte
+	n   int64
+}
+
+func (f *zstdFrameReader) Read(d []byte) (int, error) {
+	for len(f.buf) == 0 && f.n == 0 {
+		if f.stage == zstdStageDone {
+			return 0, io.EOF
+		}
+		if err := f.advance(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.buf) != 0 {
+		n := copy(d, f.buf)
+		f.buf = f.buf[n:]
+		return n, nil
+	}
+	if int64(len(d)) > f.n {
+		d = d[:f.n]
+	}
+	n, err := f.br.Read(d)
+	f.n -= int64(n)
+	return n, noEOF(err)
+}
+
+func (f *zstdFrameReader) read(n int) ([]byte, error) {
+	start := len(f.buf)
+	f.buf = append(f.buf, make([]byte, n)...)
+	if _, err := io.ReadFull(f.br, f.buf[start:]); err != nil {
+		return nil, noEOF(err)
+	}
+	return f.buf[start:], nil
+}
+
+// advance parses the next part of the frame
+func (f *zstdFrameReader) advance() error {
+	switch f.stage {
+	case zstdStageHeader:
+		b, err := f.read(5)
+		if err != nil {
+			return err
+		}
+		descriptor := b[4]
+		if descriptor&0x08 != 0 {
+			return errors.New("zstd: invalid frame header")
+		}
+		singleSegment := descriptor&0x20 != 0
+		f.checksum = descriptor&0x04 != 0
+		size := [4]int{0, 1, 2, 4}[descriptor&3]
+		if !singleSegment {
+			size++
+		}
+		switch fcs := descriptor >> 6; {
+		case fcs == 0 && singleSegment:
+			size++
+		case fcs != 0:
+			size += 1 << fcs
+		}
+		if _, err := f.read(size); err != nil {
+			return err
+		}
+		f.stage = zstdStageBlock
+	case zstdStageBlock:
+		b, err := f.read(3)
+		if err != nil {
+			return err
+		}
+		header := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		switch header >> 1 & 3 {
+		case 0, 2:
+			f.n = int64(header >> 3)
+		case 1:
+			// RLE blocks hold a single byte
+			f.n = 1
+		default:
+			return errors.New("zstd: invalid block type")
+		}
+		if header&1 != 0 {
+			f.stage = zstdStageChecksum
+		}
+	case zstdStageChecksum:
+		if f.checksum {
+			f.n = 4
+		}
+		f.stage = zstdStageDone
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
 // Signature describes a PGP signature found within a RPM while verifying it.
@@ -47,15 +48,41 @@ type Signature struct {
 	KeyFingerprint []byte
 	// PrimaryName is the primary identity of the signing key, if available.
 	PrimaryName string
+	// PubKeyAlgo is the public key algorithm that created the signature
+	PubKeyAlgo packet.PublicKeyAlgorithm
 
 	validate func(hash.Hash) error
+	newHash  func() (hash.Hash, error)
+	version  int
+}
+
+// hasher returns a new hash for digesting the signed contents. v6 signatures
+// are salted, so the salt is fed to the hash before anything else.
+func (sig *Signature) hasher() (hash.Hash, error) {
+	if sig.newHash != nil {
+		return sig.newHash()
+	}
+	if !sig.Hash.Available() {
+		return nil, fmt.Errorf("unsupported signature hash %s", sig.Hash)
+	}
+	return sig.Hash.New(), nil
 }
 
 // Verify the PGP signature over a RPM file. knownKeys should enumerate public
 // keys to check against, otherwise the signature validity cannot be verified.
 // If knownKeys is nil then digests will be checked but only the raw key ID will
 // be available.
+//
+// The payload is digested but not decompressed, so PAYLOADDIGESTALT is not
+// checked. Use PayloadOptions.VerifyDigests or Inspect to check it while the
+// payload is read.
 func Verify(stream io.Reader, knownKeys openpgp.EntityList) (header *RpmHeader, sigs []*Signature, err error) {
+	return verify(stream, knownKeys, nil)
+}
+
+// verify checks a RPM, calling policy to decide whether a signature made by a
+// key that was not valid at the time is acceptable
+func verify(stream io.Reader, knownKeys openpgp.EntityList, policy *Policy) (header *RpmHeader, sigs []*Signature, err error) {
 	lead, sigHeader, err := readSignatureHeader(stream)
 	if err != nil {
 		return nil, nil, err
@@ -75,7 +102,13 @@ func Verify(stream io.Reader, knownKeys openpgp.EntityList) (header *RpmHeader,
 	for i, sig := range sigs {
 		h := hashes[i]
 		if err := sig.validate(h); err != nil {
-			return nil, nil, err
+			var keyErr KeyValidityError
+			if policy == nil || !errors.As(err, &keyErr) {
+				return nil, nil, err
+			}
+			if err := policy.checkKeyValidity(keyErr); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 	hdr := &RpmHeader{
@@ -103,3 +136,46 @@ func (e KeyNotFoundError) Error() string {
 	}
 	return fmt.Sprintf("keyid %08x not found", e.KeyID)
 }
+
+// KeyValidityReason explains why a key could not make a signature
+type KeyValidityReason int
+
+// Reasons a key was not valid when a signature was made
+const (
+	// KeyExpired means the key or its primary key had expired
+	KeyExpired KeyValidityReason = iota + 1
+	// KeyRevoked means the key or its primary key had been revoked, or has
+	// since been revoked as compromised
+	KeyRevoked
+	// KeyNotYetValid means the key was created after the signature
+	KeyNotYetValid
+	// KeyNotForSigning means the key is not flagged for signing
+	KeyNotForSigning
+)
+
+func (r KeyValidityReason) String() string {
+	switch r {
+	case KeyExpired:
+		return "had expired"
+	case KeyRevoked:
+		return "was revoked"
+	case KeyNotYetValid:
+		return "was not valid yet"
+	case KeyNotForSigning:
+		return "was not allowed to sign"
+	default:
+		return "was not valid"
+	}
+}
+
+// KeyValidityError is returned when a signature is valid, but the key that made
+// it could not make signatures at the signature's creation time
+type KeyValidityError struct {
+	KeyID       uint64
+	Fingerprint []byte
+	Reason      KeyValidityReason
+}
+
+func (e KeyValidityError) Error() string {
+	return fmt.Sprintf("keyid %08x %s when the signature was made", e.KeyID, e.Reason)
+}
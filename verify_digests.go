@@ -2,7 +2,9 @@ package rpmutils
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -30,24 +32,102 @@ func setupDigester(sigHeader *rpmHeader, tag int, knownKeys openpgp.EntityList)
 	return parseSignature(blob, knownKeys)
 }
 
-// Parse signatures from the header and determine which hash functions are
-// needed to digest the RPM. The caller must write the payload to the returned
-// WriteCloser, then call Close to check if the payload digest matches.
-func digestAndVerify(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, knownKeys openpgp.EntityList) ([]*Signature, []hash.Hash, error) {
+// Parse all signatures that cover the general header alone. This includes the
+// legacy RSA and DSA tags plus every entry in the OPENPGP array.
+func headerSignatures(sigHeader *rpmHeader, knownKeys openpgp.EntityList) ([]*Signature, error) {
 	var sigs []*Signature
-	var hashes []hash.Hash
-	// signatures over the general header alone
+	var legacyBlobs [][]byte
 	for _, tag := range headerSigTags {
 		sig, err := setupDigester(sigHeader, tag, knownKeys)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		} else if sig == nil {
 			continue
 		}
+		sigs = append(sigs, sig)
+		blob, _ := sigHeader.GetBytes(tag)
+		legacyBlobs = append(legacyBlobs, blob)
+	}
+	blobs, err := getOpenPGPSignatures(sigHeader)
+	if err != nil {
+		return nil, err
+	}
+nextBlob:
+	for _, blob := range blobs {
+		// the first signature may also be duplicated in a legacy tag
+		for _, legacy := range legacyBlobs {
+			if bytes.Equal(blob, legacy) {
+				continue nextBlob
+			}
+		}
+		sig, err := parseSignature(blob, knownKeys)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// getOpenPGPSignatures decodes the raw signature packets stored in the OPENPGP
+// array
+func getOpenPGPSignatures(sigHeader *rpmHeader) ([][]byte, error) {
+	vals, err := sigHeader.GetStrings(SIG_OPENPGP)
+	if _, ok := err.(NoSuchTagError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	blobs := make([][]byte, len(vals))
+	for i, val := range vals {
+		blobs[i], err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OPENPGP signature %d: %w", i, err)
+		}
+	}
+	return blobs, nil
+}
+
+// Parse signatures from the header and determine which hash functions are
+// needed to digest the RPM. The caller must write the payload to the returned
+// WriteCloser, then call Close to check if the payload digest matches.
+func digestAndVerify(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, knownKeys openpgp.EntityList) ([]*Signature, []hash.Hash, error) {
+	sigs, hashes, payloadWriters, err := signatureDigests(sigHeader, genHeader, knownKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	// PAYLOADDIGESTALT would need the payload to be decompressed, so it is
+	// left to the payload readers. The payload is covered by a payload
+	// signature if it can be checked.
+	covered := knownKeys != nil && len(payloadWriters) != 0
+	var size *byteCountSink
+	if genHeader.HasTag(PAYLOADSIZE) {
+		size = new(byteCountSink)
+		payloadWriters = append(payloadWriters, size)
+	}
+	err = digestPayload(sigHeader, genHeader, payloadReader, payloadWriters, covered)
+	if err == nil {
+		err = checkPayloadSize(genHeader, size)
+	}
+	return sigs, hashes, err
+}
+
+// signatureDigests parses the signatures in the header and starts a hash for
+// each, returning the hashes that the payload must also be written to
+func signatureDigests(sigHeader, genHeader *rpmHeader, knownKeys openpgp.EntityList) ([]*Signature, []hash.Hash, []io.Writer, error) {
+	// signatures over the general header alone
+	sigs, err := headerSignatures(sigHeader, knownKeys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hashes := make([]hash.Hash, 0, len(sigs))
+	for _, sig := range sigs {
 		sig.HeaderOnly = true
-		h := sig.Hash.New()
+		h, err := sig.hasher()
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		h.Write(genHeader.orig)
-		sigs = append(sigs, sig)
 		hashes = append(hashes, h)
 	}
 	// signatures over the general header + payload
@@ -55,38 +135,79 @@ func digestAndVerify(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, k
 	for _, tag := range payloadSigTags {
 		sig, err := setupDigester(sigHeader, tag, knownKeys)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		} else if sig == nil {
 			continue
 		}
 		sig.HeaderOnly = false
-		h := sig.Hash.New()
+		h, err := sig.hasher()
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		h.Write(genHeader.orig)
 		payloadWriters = append(payloadWriters, h)
 		sigs = append(sigs, sig)
 		hashes = append(hashes, h)
 	}
-	err := digestPayload(sigHeader, genHeader, payloadReader, payloadWriters)
-	return sigs, hashes, err
+	return sigs, hashes, payloadWriters, nil
+}
+
+// checkPayloadSize compares the size of the compressed payload with
+// PAYLOADSIZE, if the package has it
+func checkPayloadSize(genHeader *rpmHeader, size *byteCountSink) error {
+	if size == nil {
+		return nil
+	}
+	expected, err := genHeader.GetUint64s(PAYLOADSIZE)
+	if err != nil {
+		return err
+	} else if len(expected) != 1 {
+		return errors.New("incorrect number of values")
+	}
+	if uint64(*size) != expected[0] {
+		return fmt.Errorf("payload size mismatch: expected %d bytes, found %d", expected[0], uint64(*size))
+	}
+	return nil
+}
+
+// digestPayload checks the payload against whichever digest it has. If there
+// is none and covered is false, the payload cannot be verified.
+func digestPayload(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, payloadWriters []io.Writer, covered bool) error {
+	digest, err := newCompressedDigest(sigHeader, genHeader)
+	if err != nil {
+		return err
+	} else if digest == nil && !covered {
+		return errors.New("no usable payload digest found")
+	}
+	if digest != nil {
+		payloadWriters = append(payloadWriters, digest)
+	}
+	if _, err := io.Copy(io.MultiWriter(payloadWriters...), payloadReader); err != nil {
+		return err
+	}
+	if digest != nil {
+		return digest.check()
+	}
+	return nil
 }
 
-func digestPayload(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, payloadWriters []io.Writer) error {
-	// Also compute a digest over the payload for integrity checking purposes
+// compressedDigest digests the compressed payload to check it against
+// PAYLOADDIGEST or SIG_MD5
+type compressedDigest struct {
+	hash.Hash
+	tag      int
+	hashType crypto.Hash
+	expected string
+}
+
+// newCompressedDigest returns nil if the package has neither digest
+func newCompressedDigest(sigHeader, genHeader *rpmHeader) (*compressedDigest, error) {
 	if payloadValue, payloadType := getPayloadDigest(genHeader); payloadType != 0 {
 		if !payloadType.Available() {
-			return fmt.Errorf("unknown payload digest %s", payloadType)
+			return nil, fmt.Errorf("unknown payload digest %s", payloadType)
 		}
-		payloadHasher := payloadType.New()
 		// hash payload only
-		payloadWriters = append(payloadWriters, payloadHasher)
-		if _, err := io.Copy(io.MultiWriter(payloadWriters...), payloadReader); err != nil {
-			return err
-		}
-		calculated := hex.EncodeToString(payloadHasher.Sum(nil))
-		if calculated != payloadValue {
-			return fmt.Errorf("payload %s digest mismatch", payloadType)
-		}
-		return nil
+		return &compressedDigest{payloadType.New(), PAYLOADDIGEST, payloadType, payloadValue}, nil
 	}
 	// Check legacy MD5 digest in sig header as a last resort. This is the only
 	// digest found in the signature header that covers the payload, so for some
@@ -94,18 +215,102 @@ func digestPayload(sigHeader, genHeader *rpmHeader, payloadReader io.Reader, pay
 	// the only integrity check we can use unless we're verifying the PGP
 	// signatures.
 	if sigmd5, _ := sigHeader.GetBytes(SIG_MD5 - _SIGHEADER_TAG_BASE); len(sigmd5) != 0 {
-		payloadHasher := md5.New()
 		// hash header + payload
-		payloadHasher.Write(genHeader.orig)
-		payloadWriters = append(payloadWriters, payloadHasher)
-		if _, err := io.Copy(io.MultiWriter(payloadWriters...), payloadReader); err != nil {
+		h := md5.New()
+		h.Write(genHeader.orig)
+		return &compressedDigest{h, SIG_MD5, crypto.MD5, hex.EncodeToString(sigmd5)}, nil
+	}
+	return nil, nil
+}
+
+func (d *compressedDigest) check() error {
+	if hex.EncodeToString(d.Sum(nil)) != d.expected {
+		return PayloadDigestError{Tag: d.tag, Hash: d.hashType}
+	}
+	return nil
+}
+
+// pipeFeeder writes to a pipe until the reader stops, then discards the rest so
+// that the other digests still see the whole payload
+type pipeFeeder struct {
+	w   *io.PipeWriter
+	err error
+}
+
+func (f *pipeFeeder) Write(d []byte) (int, error) {
+	if f.err == nil {
+		_, f.err = f.w.Write(d)
+	}
+	return len(d), nil
+}
+
+// verifiedPayload reads a decompressed payload, checking the compressed and
+// decompressed data against the digests in the header
+type verifiedPayload struct {
+	io.Reader
+	pld        io.Reader
+	compressed io.Reader
+	digest     *compressedDigest
+	alt        hash.Hash
+	altType    crypto.Hash
+	altValue   string
+}
+
+// newVerifiedPayload decompresses the payload from r. It fails if the payload
+// has no digest, unless covered is set because a signature will be checked.
+func newVerifiedPayload(r io.Reader, hdr *RpmHeader, opts PayloadOptions, covered bool) (*verifiedPayload, error) {
+	v := &verifiedPayload{compressed: r}
+	var err error
+	v.digest, err = newCompressedDigest(hdr.sigHeader, hdr.genHeader)
+	if err != nil {
+		return nil, err
+	}
+	v.altValue, v.altType = getPayloadDigestTag(hdr.genHeader, PAYLOADDIGESTALT)
+	if v.altType != 0 && v.altType.Available() {
+		v.alt = v.altType.New()
+	}
+	if v.digest == nil && v.alt == nil && !covered {
+		return nil, errors.New("no usable payload digest found")
+	}
+	if v.digest != nil {
+		v.compressed = io.TeeReader(r, v.digest)
+	}
+	v.pld, err = uncompressPayload(v.compressed, hdr, opts)
+	if err != nil {
+		return nil, err
+	}
+	v.Reader = v.pld
+	if v.alt != nil {
+		v.Reader = io.TeeReader(v.pld, v.alt)
+	}
+	return v, nil
+}
+
+// finish reads the rest of the payload and checks the digests
+func (v *verifiedPayload) finish() error {
+	// the cpio trailer may be followed by padding, and the compressed stream
+	// by data the decompressor didn't need
+	if _, err := io.Copy(io.Discard, v.Reader); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, v.compressed); err != nil {
+		return err
+	}
+	if v.digest != nil {
+		if err := v.digest.check(); err != nil {
 			return err
 		}
-		calculated := payloadHasher.Sum(nil)
-		if !bytes.Equal(calculated, sigmd5) {
-			return errors.New("md5 digest mismatch")
-		}
-		return nil
 	}
-	return errors.New("no usable payload digest found")
+	if v.alt != nil && hex.EncodeToString(v.alt.Sum(nil)) != v.altValue {
+		return PayloadDigestError{Tag: PAYLOADDIGESTALT, Hash: v.altType}
+	}
+	return nil
+}
+
+// Close closes the decompressor
+func (v *verifiedPayload) Close() error {
+	if c, ok := v.pld.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/sassoftware/go-rpmutils/cpio"
+)
+
+// FileMismatchKind identifies what did not match in a FileMismatch
+type FileMismatchKind int
+
+// Kinds of file mismatch
+const (
+	// FileMissing means the file is listed in the header but is not in the
+	// payload, and is not a %ghost
+	FileMissing FileMismatchKind = iota + 1
+	// FileSizeMismatch means the size of the contents doesn't match FILESIZES
+	FileSizeMismatch
+	// FileDigestMismatch means the digest of the contents doesn't match
+	// FILEDIGESTS
+	FileDigestMismatch
+	// FileLinkMismatch means the target of a symlink doesn't match FILELINKTOS
+	FileLinkMismatch
+	// FileIMASignatureInvalid means the IMA signature in FILESIGNATURES
+	// doesn't match FILEDIGESTS or couldn't be checked
+	FileIMASignatureInvalid
+	// FileVeritySignatureInvalid means the fs-verity signature in
+	// SIG_VERITYSIGNATURES doesn't match the contents or couldn't be checked
+	FileVeritySignatureInvalid
+)
+
+func (k FileMismatchKind) String() string {
+	switch k {
+	case FileMissing:
+		return "missing"
+	case FileSizeMismatch:
+		return "size"
+	case FileDigestMismatch:
+		return "digest"
+	case FileLinkMismatch:
+		return "link target"
+	case FileIMASignatureInvalid:
+		return "IMA signature"
+	case FileVeritySignatureInvalid:
+		return "fs-verity signature"
+	default:
+		return "unknown"
+	}
+}
+
+// FileMismatch describes a file whose payload contents don't match the header
+type FileMismatch struct {
+	// Name of the file
+	Name string
+	// Kind of mismatch
+	Kind FileMismatchKind
+	// Expected is the value from the header. For signatures it is the ID of
+	// the signing key, if known.
+	Expected string
+	// Actual is the value computed from the payload. For signatures it is the
+	// reason the signature was rejected.
+	Actual string
+}
+
+func (m FileMismatch) String() string {
+	switch m.Kind {
+	case FileMissing:
+		return fmt.Sprintf("%s: missing from payload", m.Name)
+	case FileIMASignatureInvalid, FileVeritySignatureInvalid:
+		return fmt.Sprintf("%s: %s invalid: %s", m.Name, m.Kind, m.Actual)
+	}
+	return fmt.Sprintf("%s: %s mismatch: expected %s, got %s", m.Name, m.Kind, m.Expected, m.Actual)
+}
+
+// fileContents is the size and digest computed for a file's payload contents
+type fileContents struct {
+	size   int64
+	digest string
+	verity *verityHasher
+}
+
+// VerifyFiles reads the payload of a RPM and checks each file against the
+// sizes, digests and link targets in the header. It returns every mismatch
+// found, or an error if the payload can't be read.
+//
+// Files in a hardlink group are checked against the contents stored with the
+// last member of the group. %ghost files are not expected in the payload.
+func VerifyFiles(rpm *Rpm) ([]FileMismatch, error) {
+	return verifyFiles(rpm, false, nil)
+}
+
+// VerifyFileSignatures checks the payload of a RPM as VerifyFiles does, and
+// also checks the IMA and fs-verity signatures of each file against keys. IMA
+// signatures are checked against FILEDIGESTS, while fs-verity signatures are
+// checked against a digest calculated from the payload.
+//
+// Files without signatures are not reported, so a package with no file
+// signatures at all only gets the checks done by VerifyFiles.
+func VerifyFileSignatures(rpm *Rpm, keys []*FileSigningKey) ([]FileMismatch, error) {
+	return verifyFiles(rpm, true, keys)
+}
+
+func verifyFiles(rpm *Rpm, checkSigs bool, keys []*FileSigningKey) ([]FileMismatch, error) {
+	hashType, err := fileDigestHash(rpm.Header)
+	if err != nil {
+		return nil, err
+	}
+	files, err := rpm.Header.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	var sigs *fileSignatureChecker
+	if checkSigs {
+		sigs, err = newFileSignatureChecker(rpm.Header, keys, len(files))
+		if err != nil {
+			return nil, err
+		}
+	}
+	pr, err := rpm.PayloadReaderExtended()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(files))
+	var regular []*fileInfo
+	contents := make(map[contentsKey]fileContents)
+	var mismatches []FileMismatch
+	for {
+		info, err := pr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		fi := info.(*fileInfo)
+		seen[fi.name] = true
+		switch fi.fileType() {
+		case cpio.S_ISREG:
+			regular = append(regular, fi)
+			if pr.IsLink() {
+				// contents come with a later member of the group
+				continue
+			}
+			h := hashType.New()
+			var w io.Writer = h
+			var verity *verityHasher
+			if sigs != nil && sigs.verity != nil {
+				verity = newVerityHasher(sigs.verityAlgo)
+				w = io.MultiWriter(h, verity)
+			}
+			size, err := io.Copy(w, pr)
+			if err != nil {
+				return nil, err
+			}
+			contents[keyContents(fi)] = fileContents{size: size, digest: hex.EncodeToString(h.Sum(nil)), verity: verity}
+		case cpio.S_ISLNK:
+			target, err := io.ReadAll(pr)
+			if err != nil {
+				return nil, err
+			}
+			if string(target) != fi.linkName {
+				mismatches = append(mismatches, FileMismatch{
+					Name:     fi.name,
+					Kind:     FileLinkMismatch,
+					Expected: fi.linkName,
+					Actual:   string(target),
+				})
+			}
+		}
+	}
+	for _, fi := range regular {
+		got, ok := contents[keyContents(fi)]
+		if !ok {
+			// the group's contents never showed up
+			mismatches = append(mismatches, FileMismatch{Name: fi.name, Kind: FileMissing})
+			continue
+		}
+		if got.size != fi.Size() {
+			mismatches = append(mismatches, FileMismatch{
+				Name:     fi.name,
+				Kind:     FileSizeMismatch,
+				Expected: strconv.FormatInt(fi.Size(), 10),
+				Actual:   strconv.FormatInt(got.size, 10),
+			})
+		}
+		if fi.digest != "" && got.digest != fi.digest {
+			mismatches = append(mismatches, FileMismatch{
+				Name:     fi.name,
+				Kind:     FileDigestMismatch,
+				Expected: fi.digest,
+				Actual:   got.digest,
+			})
+		}
+	}
+	for i, info := range files {
+		if !seen[info.Name()] && info.Flags()&RPMFILE_GHOST == 0 {
+			mismatches = append(mismatches, FileMismatch{Name: info.Name(), Kind: FileMissing})
+		}
+		if sigs == nil {
+			continue
+		}
+		fi := info.(*fileInfo)
+		if m := sigs.checkIMA(i, fi, hashType); m != nil {
+			mismatches = append(mismatches, *m)
+		}
+		if m := sigs.checkVerity(i, fi, contents[keyContents(fi)].verity); m != nil {
+			mismatches = append(mismatches, *m)
+		}
+	}
+	return mismatches, nil
+}
+
+// contentsKey identifies the contents of a file, which are shared by all the
+// members of a hardlink group
+type contentsKey struct {
+	inode uint64
+	name  string
+}
+
+func keyContents(fi *fileInfo) contentsKey {
+	if ino := fi.inode64(); ino != 0 {
+		return contentsKey{inode: ino}
+	}
+	// not part of a group
+	return contentsKey{name: fi.name}
+}
+
+// fileDigestHash returns the hash used for FILEDIGESTS, which is MD5 if
+// FILEDIGESTALGO is not set
+func fileDigestHash(hdr *RpmHeader) (crypto.Hash, error) {
+	algos, err := hdr.GetUint32s(FILEDIGESTALGO)
+	if errors.As(err, &NoSuchTagError{}) || (err == nil && len(algos) == 0) {
+		return crypto.MD5, nil
+	} else if err != nil {
+		return 0, err
+	}
+	hashType := hashFromAlgo(algos[0])
+	if hashType == 0 || !hashType.Available() {
+		return 0, fmt.Errorf("unsupported file digest algorithm %d", algos[0])
+	}
+	return hashType, nil
+}
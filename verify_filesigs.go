@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// FileSigningKey is a key that IMA and fs-verity file signatures can be
+// checked against
+type FileSigningKey struct {
+	PublicKey crypto.PublicKey
+	// KeyID is the IMA key identifier, the last 4 bytes of the key's subject
+	// key identifier
+	KeyID uint32
+
+	cert *x509.Certificate
+}
+
+// FileSigningKeyFromCertificate makes a FileSigningKey from a X.509
+// certificate. fs-verity signers are matched to the certificate by issuer and
+// serial number.
+func FileSigningKeyFromCertificate(cert *x509.Certificate) (*FileSigningKey, error) {
+	key, err := FileSigningKeyFromPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(cert.SubjectKeyId); n >= 4 {
+		key.KeyID = binary.BigEndian.Uint32(cert.SubjectKeyId[n-4:])
+	}
+	key.cert = cert
+	return key, nil
+}
+
+// FileSigningKeyFromPublicKey makes a FileSigningKey from a bare RSA or ECDSA
+// public key. The key ID is calculated the same way as evmctl does.
+func FileSigningKeyFromPublicKey(pub crypto.PublicKey) (*FileSigningKey, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported file signing key type %T", pub)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return &FileSigningKey{
+		PublicKey: pub,
+		KeyID:     binary.BigEndian.Uint32(sum[16:]),
+	}, nil
+}
+
+// verifyDigestSignature checks a signature made directly over a digest
+func verifyDigestSignature(pub crypto.PublicKey, hashType crypto.Hash, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hashType, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported file signing key type %T", pub)
+	}
+}
+
+// imaHash maps the kernel's hash_algo enumeration to a hash
+func imaHash(algo byte) crypto.Hash {
+	switch algo {
+	case 1:
+		return crypto.MD5
+	case 2:
+		return crypto.SHA1
+	case 4:
+		return crypto.SHA256
+	case 5:
+		return crypto.SHA384
+	case 6:
+		return crypto.SHA512
+	case 7:
+		return crypto.SHA224
+	default:
+		return 0
+	}
+}
+
+// fileSignatureChecker checks the IMA and fs-verity signatures of the files of
+// a package
+type fileSignatureChecker struct {
+	keys       []*FileSigningKey
+	ima        []string
+	verity     []string
+	verityAlgo uint32
+}
+
+func newFileSignatureChecker(hdr *RpmHeader, keys []*FileSigningKey, fileCount int) (*fileSignatureChecker, error) {
+	c := &fileSignatureChecker{keys: keys, verityAlgo: FSVERITY_HASH_ALG_SHA256}
+	var err error
+	c.ima, err = fileSignatureTag(hdr, fileCount, FILESIGNATURES, SIG_FILESIGNATURES)
+	if err != nil {
+		return nil, err
+	}
+	// rpm only defines the fs-verity tags in the signature range
+	c.verity, err = fileSignatureTag(hdr, fileCount, SIG_VERITYSIGNATURES)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.HasTag(SIG_VERITYSIGNATUREALGO) {
+		c.verityAlgo, err = hdr.GetUint32(SIG_VERITYSIGNATUREALGO)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.verity != nil && verityHash(c.verityAlgo) == 0 {
+		return nil, fmt.Errorf("unsupported fs-verity hash algorithm %d", c.verityAlgo)
+	}
+	return c, nil
+}
+
+// fileSignatureTag returns the per-file signatures from the first of tags
+// that the package has
+func fileSignatureTag(hdr *RpmHeader, fileCount int, tags ...int) ([]string, error) {
+	for _, t := range tags {
+		if !hdr.HasTag(t) {
+			continue
+		}
+		sigs, err := hdr.GetStrings(t)
+		if err != nil {
+			return nil, err
+		}
+		if len(sigs) != fileCount {
+			return nil, fmt.Errorf("tag %d has %d signatures for %d files", t, len(sigs), fileCount)
+		}
+		return sigs, nil
+	}
+	return nil, nil
+}
+
+// checkIMA checks the IMA signature of file i against its digest in
+// FILEDIGESTS
+func (c *fileSignatureChecker) checkIMA(i int, fi *fileInfo, hashType crypto.Hash) *FileMismatch {
+	if c.ima == nil || c.ima[i] == "" {
+		return nil
+	}
+	fail := func(keyID, reason string) *FileMismatch {
+		return &FileMismatch{Name: fi.name, Kind: FileIMASignatureInvalid, Expected: keyID, Actual: reason}
+	}
+	sig, err := hex.DecodeString(c.ima[i])
+	if err != nil {
+		return fail("", "malformed signature")
+	}
+	if len(sig) > 0 && sig[0] == 3 {
+		// strip the xattr type byte
+		sig = sig[1:]
+	}
+	// version, hash algorithm, key ID, signature size, signature
+	if len(sig) < 8 || sig[0] != 2 || int(binary.BigEndian.Uint16(sig[6:])) != len(sig)-8 {
+		return fail("", "malformed signature")
+	}
+	keyID := binary.BigEndian.Uint32(sig[2:])
+	keyName := fmt.Sprintf("%08x", keyID)
+	if imaHash(sig[1]) != hashType {
+		return fail(keyName, fmt.Sprintf("signature algorithm %d does not match the file digests", sig[1]))
+	}
+	digest, err := hex.DecodeString(fi.digest)
+	if err != nil {
+		return fail(keyName, "malformed file digest")
+	}
+	found := false
+	for _, key := range c.keys {
+		if key.KeyID != keyID {
+			continue
+		}
+		found = true
+		if verifyDigestSignature(key.PublicKey, hashType, digest, sig[8:]) == nil {
+			return nil
+		}
+	}
+	if !found {
+		return fail(keyName, "no matching key")
+	}
+	return fail(keyName, "bad signature")
+}
+
+// checkVerity checks the fs-verity signature of file i against the digest
+// calculated from its contents
+func (c *fileSignatureChecker) checkVerity(i int, fi *fileInfo, v *verityHasher) *FileMismatch {
+	if c.verity == nil || c.verity[i] == "" {
+		return nil
+	}
+	fail := func(reason string) *FileMismatch {
+		return &FileMismatch{Name: fi.name, Kind: FileVeritySignatureInvalid, Actual: reason}
+	}
+	if v == nil {
+		return fail("contents not found")
+	}
+	der, err := base64.StdEncoding.DecodeString(c.verity[i])
+	if err != nil {
+		return fail("malformed signature")
+	}
+	sd, err := parsePKCS7(der)
+	if err != nil {
+		return fail(err.Error())
+	}
+	content := v.formattedDigest()
+	found := false
+	for _, si := range sd.SignerInfos {
+		hashType, digest, err := si.signedDigest(content)
+		if err != nil {
+			return fail(err.Error())
+		}
+		for _, key := range c.keys {
+			if key.cert != nil && (!bytes.Equal(key.cert.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) ||
+				key.cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.Serial) != 0) {
+				continue
+			}
+			found = true
+			if verifyDigestSignature(key.PublicKey, hashType, digest, si.EncryptedDigest) == nil {
+				return nil
+			}
+		}
+	}
+	if !found {
+		return fail("no matching key")
+	}
+	return fail("bad signature")
+}
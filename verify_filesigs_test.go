@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sassoftware/go-rpmutils/cpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerityDigest(t *testing.T) {
+	empty := newVerityHasher(FSVERITY_HASH_ALG_SHA256)
+	assert.Equal(t, make([]byte, 32), empty.rootHash())
+	// a single block is its own root
+	small := newVerityHasher(FSVERITY_HASH_ALG_SHA256)
+	small.Write([]byte("hello"))
+	block := make([]byte, verityBlockSize)
+	copy(block, "hello")
+	sum := sha256.Sum256(block)
+	assert.Equal(t, sum[:], small.rootHash())
+	// 129 blocks need two levels of 32-byte hashes
+	large := newVerityHasher(FSVERITY_HASH_ALG_SHA256)
+	large.Write(bytes.Repeat([]byte{1}, 129*verityBlockSize))
+	leaf := sha256.Sum256(bytes.Repeat([]byte{1}, verityBlockSize))
+	level := bytes.Repeat(leaf[:], 128)
+	first := sha256.Sum256(level)
+	second := sha256.Sum256(append(leaf[:], make([]byte, verityBlockSize-32)...))
+	root := sha256.Sum256(append(append(first[:], second[:]...), make([]byte, verityBlockSize-64)...))
+	assert.Equal(t, root[:], large.rootHash())
+}
+
+func TestVerifyFileSignatures(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1234),
+		Subject:               pkix.Name{CommonName: "file signing"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	key, err := FileSigningKeyFromCertificate(cert)
+	require.NoError(t, err)
+	bareKey, err := FileSigningKeyFromPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	// both ways of deriving the key ID agree
+	assert.Equal(t, key.KeyID, bareKey.KeyID)
+
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	rpm, err := ReadRpm(f)
+	require.NoError(t, err)
+	files, err := rpm.Header.GetFiles()
+	require.NoError(t, err)
+	contents := map[string][]byte{"/config": []byte("config\n"), "/normal": []byte("normal\n")}
+
+	// sign every regular file
+	imaSigs := make([]string, len(files))
+	veritySigs := make([]string, len(files))
+	for i, info := range files {
+		if info.Mode()&^07777 != cpio.S_ISREG {
+			continue
+		}
+		digest, err := hex.DecodeString(info.Digest())
+		require.NoError(t, err)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.MD5, digest)
+		require.NoError(t, err)
+		ima := []byte{3, 2, 1, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(ima[3:], key.KeyID)
+		binary.BigEndian.PutUint16(ima[7:], uint16(len(sig)))
+		imaSigs[i] = hex.EncodeToString(append(ima, sig...))
+
+		v := newVerityHasher(FSVERITY_HASH_ALG_SHA256)
+		v.Write(contents[info.Name()])
+		veritySigs[i] = base64.StdEncoding.EncodeToString(signPKCS7(t, priv, cert, v.formattedDigest()))
+	}
+	rpm.Header.sigHeader.setStrings(SIG_FILESIGNATURES, RPM_STRING_ARRAY_TYPE, imaSigs)
+	rpm.Header.sigHeader.setStrings(SIG_VERITYSIGNATURES, RPM_STRING_ARRAY_TYPE, veritySigs)
+	rpm.Header.sigHeader.setUint32s(SIG_VERITYSIGNATUREALGO, []uint32{FSVERITY_HASH_ALG_SHA256})
+
+	verify := func(keys ...*FileSigningKey) []FileMismatch {
+		_, err := f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		hdr := rpm.Header
+		rpm, err := ReadRpm(f)
+		require.NoError(t, err)
+		rpm.Header = hdr
+		mismatches, err := VerifyFileSignatures(rpm, keys)
+		require.NoError(t, err)
+		return mismatches
+	}
+	assert.Empty(t, verify(key))
+	assert.Empty(t, verify(bareKey))
+
+	// unknown key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := FileSigningKeyFromPublicKey(&other.PublicKey)
+	require.NoError(t, err)
+	mismatches := verify(otherKey)
+	require.Len(t, mismatches, 4)
+	assert.Equal(t, FileMismatch{Name: "/config", Kind: FileIMASignatureInvalid, Expected: hexKeyID(key.KeyID), Actual: "no matching key"}, mismatches[0])
+	assert.Equal(t, FileMismatch{Name: "/config", Kind: FileVeritySignatureInvalid, Actual: "bad signature"}, mismatches[1])
+
+	// tampered signatures
+	imaSigs[0] = imaSigs[2]
+	veritySigs[0] = veritySigs[2]
+	rpm.Header.sigHeader.setStrings(SIG_FILESIGNATURES, RPM_STRING_ARRAY_TYPE, imaSigs)
+	rpm.Header.sigHeader.setStrings(SIG_VERITYSIGNATURES, RPM_STRING_ARRAY_TYPE, veritySigs)
+	mismatches = verify(key)
+	assert.Equal(t, []FileMismatch{
+		{Name: "/config", Kind: FileIMASignatureInvalid, Expected: hexKeyID(key.KeyID), Actual: "bad signature"},
+		{Name: "/config", Kind: FileVeritySignatureInvalid, Actual: "bad signature"},
+	}, mismatches)
+	assert.Equal(t, "/config: IMA signature invalid: bad signature", mismatches[0].String())
+}
+
+func hexKeyID(keyID uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], keyID)
+	return hex.EncodeToString(b[:])
+}
+
+// signPKCS7 makes a detached signature the same way as fsverity-utils
+func signPKCS7(t *testing.T, priv *rsa.PrivateKey, cert *x509.Certificate, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	sha256Algo := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algo},
+		ContentInfo:      pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: pkcs7IssuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+				Serial: cert.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Algo,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}},
+			EncryptedDigest:           sig,
+		}},
+	}
+	sdDER, err := asn1.Marshal(sd)
+	require.NoError(t, err)
+	der, err := asn1.Marshal(pkcs7ContentInfo{ContentType: oidSignedData, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdDER}})
+	require.NoError(t, err)
+	return der
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"crypto"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Guarantee is a set of properties of a RPM established by verifying it
+type Guarantee int
+
+// Guarantees that verification can establish
+const (
+	// GuaranteeHeaderDigest means the general header matches the strongest
+	// digest in the signature header: SHA3-256, SHA256 or SHA1, in that order
+	// of preference
+	GuaranteeHeaderDigest Guarantee = 1 << iota
+	// GuaranteeHeaderSignature means the general header is signed by a known
+	// key
+	GuaranteeHeaderSignature
+	// GuaranteePayloadDigest means the payload matches its digest
+	GuaranteePayloadDigest
+	// GuaranteePayloadSignature means the general header and payload are
+	// signed by a known key
+	GuaranteePayloadSignature
+)
+
+var guaranteeNames = []string{"header digest", "header signature", "payload digest", "payload signature"}
+
+func (g Guarantee) String() string {
+	var names []string
+	for i, name := range guaranteeNames {
+		if g&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// HeaderVerification is the result of VerifyHeaderOnly
+type HeaderVerification struct {
+	// Signatures over the general header alone. If knownKeys was nil, they
+	// were parsed but not validated.
+	Signatures []*Signature
+	// PayloadSignatures over the general header and payload. They were parsed
+	// but not validated.
+	PayloadSignatures []*Signature
+	// HeaderDigest is the digest the general header was checked against, or 0
+	// if the package has no header digest
+	HeaderDigest crypto.Hash
+	// Checked holds the guarantees that were established
+	Checked Guarantee
+	// NotChecked holds the guarantees the package could provide, but that
+	// were skipped
+	NotChecked Guarantee
+}
+
+// VerifyHeaderOnly checks the signatures and digest that cover the general
+// header alone, without digesting the payload. This is much faster than Verify
+// for large packages, but establishes nothing about the payload: the result
+// lists which guarantees were and were not checked. knownKeys should enumerate
+// the trusted public keys; if it is nil, signatures are parsed but not
+// validated.
+//
+// If stream is seekable, it is left positioned at the end without reading the
+// payload. Otherwise the payload is read and discarded.
+func VerifyHeaderOnly(stream io.Reader, knownKeys openpgp.EntityList) (*RpmHeader, *HeaderVerification, error) {
+	lead, sigHeader, err := readSignatureHeader(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	headerDigestValue, headerDigestType := getHashAndType(sigHeader)
+	genHeader, err := readHeader(stream, headerDigestValue, headerDigestType, sigHeader.isSource, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := new(HeaderVerification)
+	if headerDigestValue != "" {
+		result.HeaderDigest = headerDigestType
+		result.Checked |= GuaranteeHeaderDigest
+	}
+	// signatures over the general header alone
+	result.Signatures, err = headerSignatures(sigHeader, knownKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, sig := range result.Signatures {
+		sig.HeaderOnly = true
+		h, err := sig.hasher()
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Write(genHeader.orig)
+		if err := sig.validate(h); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(result.Signatures) != 0 {
+		if knownKeys != nil {
+			result.Checked |= GuaranteeHeaderSignature
+		} else {
+			result.NotChecked |= GuaranteeHeaderSignature
+		}
+	}
+	// signatures and digests that need the payload
+	for _, tag := range payloadSigTags {
+		sig, err := setupDigester(sigHeader, tag, nil)
+		if err != nil {
+			return nil, nil, err
+		} else if sig != nil {
+			result.PayloadSignatures = append(result.PayloadSignatures, sig)
+			result.NotChecked |= GuaranteePayloadSignature
+		}
+	}
+	_, payloadType := getPayloadDigest(genHeader)
+	_, altType := getPayloadDigestTag(genHeader, PAYLOADDIGESTALT)
+	if payloadType != 0 || altType != 0 || sigHeader.HasTag(SIG_MD5-_SIGHEADER_TAG_BASE) {
+		result.NotChecked |= GuaranteePayloadDigest
+	}
+	if err := skipPayload(stream); err != nil {
+		return nil, nil, err
+	}
+	hdr := &RpmHeader{
+		lead:      lead,
+		sigHeader: sigHeader,
+		genHeader: genHeader,
+		isSource:  sigHeader.isSource,
+	}
+	return hdr, result, nil
+}
+
+// skipPayload moves stream to the end of the payload, without reading it if
+// possible
+func skipPayload(stream io.Reader) error {
+	if seeker, ok := stream.(io.Seeker); ok {
+		_, err := seeker.Seek(0, io.SeekEnd)
+		return err
+	}
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
@@ -3,10 +3,174 @@
 package rpmutils
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"time"
+
 	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
 func parseSignatureMaybeV3(genpkt packet.Packet, knownKeys openpgp.EntityList) (*Signature, error) {
 	return parseSignatureV4(genpkt, knownKeys)
 }
+
+// parseRawSignatureV3 parses a v3 signature packet, which the PGP library can't
+// read, and verifies it with RSA or DSA keys. It returns nil if blob is not a
+// v3 signature.
+func parseRawSignatureV3(blob []byte, knownKeys openpgp.EntityList) (*Signature, error) {
+	body, rest, ok := signaturePacketBody(blob)
+	if !ok || len(body) == 0 || body[0] != 3 {
+		return nil, nil
+	} else if len(rest) > 0 {
+		return nil, ErrTrailingGarbage
+	}
+	// version, hashed length, signature type, creation time, key ID, public
+	// key algorithm, hash algorithm, hash tag, then the MPIs
+	if len(body) < 19 || body[1] != 5 {
+		return nil, errors.New("malformed v3 signature")
+	}
+	hashed := body[2:7]
+	hashTag := body[17:19]
+	mpis, err := readMPIs(body[19:])
+	if err != nil {
+		return nil, err
+	}
+	sig := &Signature{
+		Hash:         hashFromAlgo(uint32(body[16])),
+		CreationTime: time.Unix(int64(binary.BigEndian.Uint32(body[3:7])), 0),
+		KeyId:        binary.BigEndian.Uint64(body[7:15]),
+		PubKeyAlgo:   packet.PublicKeyAlgorithm(body[15]),
+		version:      3,
+	}
+	if sig.Hash == 0 {
+		return nil, fmt.Errorf("unsupported signature hash algorithm %d", body[16])
+	}
+	sig.validate = func(h hash.Hash) error {
+		if knownKeys == nil {
+			return nil
+		}
+		keys := knownKeys.KeysById(sig.KeyId)
+		if len(keys) == 0 || keys[0].PublicKey == nil {
+			return KeyNotFoundError{KeyID: sig.KeyId}
+		}
+		setEntity(sig, keys[0].Entity)
+		h.Write(hashed)
+		digest := h.Sum(nil)
+		if !bytes.Equal(digest[:2], hashTag) {
+			return pgperrors.SignatureError("hash tag doesn't match")
+		}
+		if err := verifyV3(keys[0].PublicKey, sig.Hash, digest, mpis); err != nil {
+			return err
+		}
+		return checkKeyValidity(keys[0].Entity, keys[0].PublicKey, sig.CreationTime)
+	}
+	return sig, nil
+}
+
+// signaturePacketBody returns the body of the signature packet at the start of
+// blob, and whatever follows it
+func signaturePacketBody(blob []byte) (body, rest []byte, ok bool) {
+	if len(blob) < 2 || blob[0]&0x80 == 0 {
+		return nil, nil, false
+	}
+	var length, offset int
+	if blob[0]&0x40 == 0 {
+		// old format: the tag and length type are in the first byte
+		if (blob[0]>>2)&0xf != 2 {
+			return nil, nil, false
+		}
+		switch blob[0] & 3 {
+		case 0:
+			length, offset = int(blob[1]), 2
+		case 1:
+			if len(blob) < 3 {
+				return nil, nil, false
+			}
+			length, offset = int(binary.BigEndian.Uint16(blob[1:])), 3
+		case 2:
+			if len(blob) < 5 {
+				return nil, nil, false
+			}
+			length, offset = int(binary.BigEndian.Uint32(blob[1:])), 5
+		default:
+			return nil, nil, false
+		}
+	} else {
+		// new format, without partial lengths
+		if blob[0]&0x3f != 2 {
+			return nil, nil, false
+		}
+		switch {
+		case blob[1] < 192:
+			length, offset = int(blob[1]), 2
+		case blob[1] < 224 && len(blob) >= 3:
+			length, offset = (int(blob[1])-192)<<8+int(blob[2])+192, 3
+		case blob[1] == 255 && len(blob) >= 6:
+			length, offset = int(binary.BigEndian.Uint32(blob[2:])), 6
+		default:
+			return nil, nil, false
+		}
+	}
+	if length < 0 || len(blob)-offset < length {
+		return nil, nil, false
+	}
+	return blob[offset : offset+length], blob[offset+length:], true
+}
+
+// readMPIs parses the multiprecision integers at the end of a signature
+func readMPIs(d []byte) ([]*big.Int, error) {
+	var mpis []*big.Int
+	for len(d) > 0 {
+		if len(d) < 2 {
+			return nil, errors.New("malformed v3 signature")
+		}
+		n := (int(binary.BigEndian.Uint16(d)) + 7) / 8
+		if len(d)-2 < n {
+			return nil, errors.New("malformed v3 signature")
+		}
+		mpis = append(mpis, new(big.Int).SetBytes(d[2:2+n]))
+		d = d[2+n:]
+	}
+	return mpis, nil
+}
+
+// verifyV3 checks the MPIs of a v3 signature over digest
+func verifyV3(key *packet.PublicKey, hashType crypto.Hash, digest []byte, mpis []*big.Int) error {
+	switch pub := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if len(mpis) != 1 {
+			return pgperrors.SignatureError("RSA signature has the wrong number of values")
+		}
+		if mpis[0].BitLen() > pub.N.BitLen() {
+			return pgperrors.SignatureError("RSA signature too long")
+		}
+		// leading zeroes are stripped from the MPI
+		s := mpis[0].FillBytes(make([]byte, pub.Size()))
+		if err := rsa.VerifyPKCS1v15(pub, hashType, digest, s); err != nil {
+			return pgperrors.SignatureError("RSA verification failure")
+		}
+		return nil
+	case *dsa.PublicKey:
+		if len(mpis) != 2 {
+			return pgperrors.SignatureError("DSA signature has the wrong number of values")
+		}
+		// DSA signs the leftmost bits of the digest that fit in Q
+		if n := (pub.Q.BitLen() + 7) / 8; len(digest) > n {
+			digest = digest[:n]
+		}
+		if !dsa.Verify(pub, digest, mpis[0], mpis[1]) {
+			return pgperrors.SignatureError("DSA verification failure")
+		}
+		return nil
+	}
+	return fmt.Errorf("v3 signatures can't be verified with %s keys", pubKeyAlgoName(key.PubKeyAlgo))
+}
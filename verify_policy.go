@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Policy describes the requirements a RPM must meet in VerifyWithPolicy, on
+// top of all of its signatures and digests being valid
+type Policy struct {
+	// RequireHeaderSignature requires at least one valid signature over the
+	// general header alone
+	RequireHeaderSignature bool
+	// RequirePayloadSignature requires at least one valid signature over the
+	// general header and payload
+	RequirePayloadSignature bool
+	// MinHash is the weakest hash accepted for signatures, ranked by digest
+	// size. If not set, any hash is accepted.
+	MinHash crypto.Hash
+	// RejectWeakDigests rejects packages whose general header or payload is
+	// not covered by a digest or valid signature stronger than SHA-1
+	RejectWeakDigests bool
+	// Fingerprints, if set, requires at least one valid signature from a key
+	// with one of the given primary key fingerprints
+	Fingerprints [][]byte
+	// AllowExpiredKeys accepts signatures made after the signing key expired
+	AllowExpiredKeys bool
+	// AllowRevokedKeys accepts signatures made by revoked keys
+	AllowRevokedKeys bool
+	// AllowNonSigningKeys accepts signatures made by subkeys that are not
+	// flagged for signing
+	AllowNonSigningKeys bool
+}
+
+// PolicyRule identifies the part of a Policy that was violated
+type PolicyRule int
+
+// Policy rules
+const (
+	RuleHeaderSignature PolicyRule = iota + 1
+	RulePayloadSignature
+	RuleMinHash
+	RuleWeakDigest
+	RuleFingerprint
+	RuleExpiredKey
+	RuleRevokedKey
+	RuleNonSigningKey
+)
+
+// PolicyViolation is returned by VerifyWithPolicy when a RPM does not meet the
+// policy
+type PolicyViolation struct {
+	// Rule that was violated
+	Rule PolicyRule
+	// KeyId is the key that made the offending signature, for rules that
+	// apply to a single signature
+	KeyId uint64
+	// Reason describes the violation
+	Reason string
+}
+
+func (e PolicyViolation) Error() string {
+	return "verification policy violated: " + e.Reason
+}
+
+// VerifyWithPolicy verifies a RPM as Verify does, then checks the result
+// against policy. knownKeys should enumerate the trusted public keys; if it is
+// nil, no signature can count towards the policy's requirements. Signatures
+// from keys that were expired, revoked or not allowed to sign at the time are
+// only accepted if the policy allows it.
+//
+// A signature or digest that fails to verify is returned as the underlying
+// error, while valid packages that do not meet the policy return a
+// PolicyViolation. A nil policy is the same as an empty one.
+func VerifyWithPolicy(stream io.Reader, knownKeys openpgp.EntityList, policy *Policy) (*RpmHeader, []*Signature, error) {
+	if policy == nil {
+		policy = new(Policy)
+	}
+	hdr, sigs, err := verify(stream, knownKeys, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := policy.check(hdr, sigs); err != nil {
+		return nil, nil, err
+	}
+	return hdr, sigs, nil
+}
+
+func (policy *Policy) check(hdr *RpmHeader, sigs []*Signature) error {
+	var header, payload, fingerprint bool
+	// strong signatures cover what they sign as well as a digest would
+	var strongHeader, strongPayload bool
+	for _, sig := range sigs {
+		if sig.Signer == nil {
+			// not validated
+			continue
+		}
+		if err := policy.checkSignature(sig); err != nil {
+			return err
+		}
+		if sig.HeaderOnly {
+			header = true
+		} else {
+			payload = true
+		}
+		if !weakHash(sig.Hash) {
+			strongHeader = true
+			strongPayload = strongPayload || !sig.HeaderOnly
+		}
+		for _, fp := range policy.Fingerprints {
+			if bytes.Equal(fp, sig.Signer.PrimaryKey.Fingerprint) {
+				fingerprint = true
+			}
+		}
+	}
+	switch {
+	case policy.RequireHeaderSignature && !header:
+		return PolicyViolation{Rule: RuleHeaderSignature, Reason: "no valid header signature"}
+	case policy.RequirePayloadSignature && !payload:
+		return PolicyViolation{Rule: RulePayloadSignature, Reason: "no valid header and payload signature"}
+	case len(policy.Fingerprints) != 0 && !fingerprint:
+		return PolicyViolation{Rule: RuleFingerprint, Reason: "no valid signature from a required key"}
+	}
+	if !policy.RejectWeakDigests {
+		return nil
+	}
+	if !strongHeader {
+		switch digest, hashType := getHashAndType(hdr.sigHeader); {
+		case digest == "":
+			return PolicyViolation{Rule: RuleWeakDigest, Reason: "header is not covered by any digest"}
+		case weakHash(hashType):
+			return PolicyViolation{Rule: RuleWeakDigest, Reason: fmt.Sprintf("header is only covered by a %s digest", hashType)}
+		}
+	}
+	if !strongPayload {
+		// PAYLOADDIGESTALT doesn't count, as verifying doesn't check it
+		_, hashType := getPayloadDigest(hdr.genHeader)
+		switch {
+		case hashType == 0 && hdr.sigHeader.HasTag(SIG_MD5-_SIGHEADER_TAG_BASE):
+			return PolicyViolation{Rule: RuleWeakDigest, Reason: "payload is only covered by a MD5 digest"}
+		case hashType == 0:
+			return PolicyViolation{Rule: RuleWeakDigest, Reason: "payload is not covered by any digest"}
+		case weakHash(hashType):
+			return PolicyViolation{Rule: RuleWeakDigest, Reason: fmt.Sprintf("payload is only covered by a %s digest", hashType)}
+		}
+	}
+	return nil
+}
+
+func (policy *Policy) checkSignature(sig *Signature) error {
+	if policy.MinHash != 0 && hashStrength(sig.Hash) < hashStrength(policy.MinHash) {
+		return PolicyViolation{
+			Rule:   RuleMinHash,
+			KeyId:  sig.KeyId,
+			Reason: fmt.Sprintf("signature from %08x uses %s, which is weaker than %s", sig.KeyId, sig.Hash, policy.MinHash),
+		}
+	}
+	return nil
+}
+
+// checkKeyValidity decides whether a signature from a key that was not valid
+// at the time is acceptable
+func (policy *Policy) checkKeyValidity(keyErr KeyValidityError) error {
+	violation := PolicyViolation{KeyId: keyErr.KeyID, Reason: keyErr.Error()}
+	switch keyErr.Reason {
+	case KeyExpired:
+		if policy.AllowExpiredKeys {
+			return nil
+		}
+		violation.Rule = RuleExpiredKey
+	case KeyRevoked:
+		if policy.AllowRevokedKeys {
+			return nil
+		}
+		violation.Rule = RuleRevokedKey
+	case KeyNotForSigning:
+		if policy.AllowNonSigningKeys {
+			return nil
+		}
+		violation.Rule = RuleNonSigningKey
+	default:
+		return keyErr
+	}
+	return violation
+}
+
+// hashStrength ranks hashes by digest size
+func hashStrength(h crypto.Hash) int {
+	if !h.Available() {
+		return 0
+	}
+	return h.Size()
+}
+
+func weakHash(h crypto.Hash) bool {
+	return h == crypto.MD5 || h == crypto.SHA1
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func verifyPolicyFile(t *testing.T, fp string, keyring openpgp.EntityList, policy *Policy) error {
+	f, err := os.Open(fp)
+	require.NoError(t, err)
+	defer f.Close()
+	_, _, err = VerifyWithPolicy(f, keyring, policy)
+	return err
+}
+
+func policyRule(err error) PolicyRule {
+	var violation PolicyViolation
+	if errors.As(err, &violation) {
+		return violation.Rule
+	}
+	return 0
+}
+
+func TestVerifyWithPolicy(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	unsigned := "testdata/simple-1.0.1-1.i386.rpm"
+	signed := copyTestRpm(t, unsigned)
+	signTestRpm(t, signed, keyring[0].PrivateKey, nil)
+	headerOnly := copyTestRpm(t, unsigned)
+	signTestRpm(t, headerOnly, keyring[0].PrivateKey, &SignatureOptions{HeaderOnly: true})
+
+	strict := &Policy{RequireHeaderSignature: true, RequirePayloadSignature: true}
+	assert.Equal(t, RuleHeaderSignature, policyRule(verifyPolicyFile(t, unsigned, keyring, strict)))
+	assert.NoError(t, verifyPolicyFile(t, signed, keyring, strict))
+	assert.Equal(t, RulePayloadSignature, policyRule(verifyPolicyFile(t, headerOnly, keyring, strict)))
+	// signatures from unvalidated keys don't count
+	assert.Equal(t, RuleHeaderSignature, policyRule(verifyPolicyFile(t, signed, nil, strict)))
+
+	assert.NoError(t, verifyPolicyFile(t, signed, keyring, &Policy{MinHash: crypto.SHA256}))
+	assert.Equal(t, RuleMinHash, policyRule(verifyPolicyFile(t, signed, keyring, &Policy{MinHash: crypto.SHA512})))
+	// this package only has SHA-1 and MD5 digests, unless a valid signature
+	// covers it
+	weak := &Policy{RejectWeakDigests: true}
+	assert.Equal(t, RuleWeakDigest, policyRule(verifyPolicyFile(t, unsigned, keyring, weak)))
+	assert.NoError(t, verifyPolicyFile(t, signed, keyring, weak))
+	assert.Equal(t, RuleWeakDigest, policyRule(verifyPolicyFile(t, signed, nil, weak)))
+	assert.Equal(t, RuleWeakDigest, policyRule(verifyPolicyFile(t, headerOnly, keyring, weak)))
+	assert.NoError(t, verifyPolicyFile(t, "testdata/payload-test-0.1-w9.gzdio.x86_64.rpm", nil, weak))
+	// a nil policy requires nothing
+	assert.NoError(t, verifyPolicyFile(t, unsigned, keyring, nil))
+
+	fingerprints := &Policy{Fingerprints: [][]byte{keyring[0].PrimaryKey.Fingerprint}}
+	assert.NoError(t, verifyPolicyFile(t, signed, keyring, fingerprints))
+	assert.Equal(t, RuleFingerprint, policyRule(verifyPolicyFile(t, unsigned, keyring, fingerprints)))
+}
+
+func TestVerifyPolicyKeyStatus(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	key, err := openpgp.NewEntity("short lived", "", "", &packet.Config{
+		RSABits:         2048,
+		KeyLifetimeSecs: 60,
+		Time:            func() time.Time { return created },
+	})
+	require.NoError(t, err)
+	keyring := openpgp.EntityList{key}
+
+	fp := copyTestRpm(t, "testdata/simple-1.0.1-1.i386.rpm")
+	signTestRpm(t, fp, key.PrivateKey, &SignatureOptions{CreationTime: created.Add(30 * time.Second)})
+	assert.NoError(t, verifyPolicyFile(t, fp, keyring, &Policy{}))
+	signTestRpm(t, fp, key.PrivateKey, nil)
+	assert.Equal(t, RuleExpiredKey, policyRule(verifyPolicyFile(t, fp, keyring, &Policy{})))
+	assert.NoError(t, verifyPolicyFile(t, fp, keyring, &Policy{AllowExpiredKeys: true}))
+
+	require.NoError(t, key.RevokeKey(packet.KeyCompromised, "lost", nil))
+	assert.Equal(t, RuleRevokedKey, policyRule(verifyPolicyFile(t, fp, keyring, &Policy{AllowExpiredKeys: true})))
+	assert.NoError(t, verifyPolicyFile(t, fp, keyring, &Policy{AllowExpiredKeys: true, AllowRevokedKeys: true}))
+}
+
+func TestVerifyKeyValidity(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	key, err := openpgp.NewEntity("test key", "", "", &packet.Config{
+		RSABits: 2048,
+		Time:    func() time.Time { return created },
+	})
+	require.NoError(t, err)
+	keyring := openpgp.EntityList{key}
+	verifyErr := func(key *packet.PrivateKey, when time.Time) error {
+		fp := copyTestRpm(t, "testdata/simple-1.0.1-1.i386.rpm")
+		signTestRpm(t, fp, key, &SignatureOptions{CreationTime: when})
+		f, err := os.Open(fp)
+		require.NoError(t, err)
+		defer f.Close()
+		_, _, err = Verify(f, keyring)
+		return err
+	}
+	reason := func(err error) KeyValidityReason {
+		var keyErr KeyValidityError
+		if errors.As(err, &keyErr) {
+			return keyErr.Reason
+		}
+		return 0
+	}
+
+	assert.NoError(t, verifyErr(key.PrivateKey, created.Add(time.Minute)))
+	assert.Equal(t, KeyNotYetValid, reason(verifyErr(key.PrivateKey, created.Add(-time.Minute))))
+	// the encryption subkey can't sign
+	assert.Equal(t, KeyNotForSigning, reason(verifyErr(key.Subkeys[0].PrivateKey, created.Add(time.Minute))))
+
+	// a retired key is still good for older signatures
+	retired := time.Now().Add(-30 * time.Minute)
+	require.NoError(t, key.RevokeKey(packet.KeyRetired, "retired", &packet.Config{
+		Time: func() time.Time { return retired },
+	}))
+	assert.NoError(t, verifyErr(key.PrivateKey, created.Add(time.Minute)))
+	assert.Equal(t, KeyRevoked, reason(verifyErr(key.PrivateKey, retired.Add(time.Minute))))
+}
+
+func TestPolicyDigestCoverage(t *testing.T) {
+	weak := &Policy{RejectWeakDigests: true}
+	readHeader := func(fp string) *RpmHeader {
+		f, err := os.Open(fp)
+		require.NoError(t, err)
+		defer f.Close()
+		hdr, err := ReadHeader(f)
+		require.NoError(t, err)
+		return hdr
+	}
+	// PAYLOADDIGESTALT isn't checked, so it doesn't cover the payload on its
+	// own
+	hdr := readHeader("testdata/payload-test-0.1-v6.x86_64.rpm")
+	require.NoError(t, weak.check(hdr, nil))
+	delete(hdr.genHeader.entries, PAYLOADDIGEST)
+	require.True(t, hdr.genHeader.HasTag(PAYLOADDIGESTALT))
+	err := weak.check(hdr, nil)
+	assert.Equal(t, RuleWeakDigest, policyRule(err))
+	assert.EqualError(t, err, "verification policy violated: payload is not covered by any digest")
+
+	// a header without any digest is not let through
+	hdr = readHeader("testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	for _, tag := range []int{SIG_SHA1, SIG_SHA256, SIG_SHA3_256} {
+		delete(hdr.sigHeader.entries, tag)
+	}
+	err = weak.check(hdr, nil)
+	assert.EqualError(t, err, "verification policy violated: header is not covered by any digest")
+}
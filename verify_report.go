@@ -0,0 +1,424 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// VerifyStatus is the outcome of checking one signature or digest
+type VerifyStatus int
+
+// Verification outcomes, named as rpm reports them
+const (
+	// StatusOK means the signature or digest is valid
+	StatusOK VerifyStatus = iota
+	// StatusBad means the signature or digest does not match, or could not be
+	// parsed
+	StatusBad
+	// StatusNoKey means the signature could not be checked because its key is
+	// not known
+	StatusNoKey
+	// StatusUnsupported means the signature or digest is present but could
+	// not be checked because its algorithm is not supported
+	StatusUnsupported
+	// StatusNotChecked means the digest is present but was deliberately not
+	// checked. Reason says why.
+	StatusNotChecked
+)
+
+func (s VerifyStatus) String() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusBad:
+		return "BAD"
+	case StatusNoKey:
+		return "NOKEY"
+	case StatusUnsupported:
+		return "UNSUPPORTED"
+	case StatusNotChecked:
+		return "NOTCHECKED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ReportItem is the result of checking one signature or digest
+type ReportItem struct {
+	// Description names the item the way rpm -Kv does, e.g. "Header SHA256
+	// digest"
+	Description string
+	// Tag holding the signature or digest
+	Tag int
+	// Status of the item
+	Status VerifyStatus
+	// Reason explains why Status is not OK
+	Reason string
+	// Signature is set for signature items that could be parsed
+	Signature *Signature
+}
+
+// VerificationReport holds the result of checking every signature and digest
+// in a RPM
+type VerificationReport struct {
+	Items []ReportItem
+}
+
+// OK returns true if every item in the report is OK, other than those that
+// were not checked
+func (r *VerificationReport) OK() bool {
+	for _, item := range r.Items {
+		if item.Status != StatusOK && item.Status != StatusNotChecked {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes the report in the same format as rpm -Kv, with name as the
+// heading. As with rpm, the reason is only shown for mismatched digests.
+func (r *VerificationReport) WriteText(w io.Writer, name string) error {
+	if _, err := fmt.Fprintf(w, "%s:\n", name); err != nil {
+		return err
+	}
+	for _, item := range r.Items {
+		status := item.Status.String()
+		if item.Status == StatusBad && item.Signature == nil && item.Reason != "" {
+			status += " (" + item.Reason + ")"
+		}
+		if _, err := fmt.Fprintf(w, "    %s: %s\n", item.Description, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyReport checks every signature and digest in a RPM independently,
+// instead of stopping at the first failure as Verify does. knownKeys should
+// enumerate public keys to check against; signatures from other keys are
+// reported as NOKEY.
+//
+// An error is only returned if the RPM can't be read. A package that fails
+// verification returns a report with items that are not OK. As with Verify,
+// PAYLOADDIGESTALT is not checked, and is reported as NOTCHECKED.
+func VerifyReport(stream io.Reader, knownKeys openpgp.EntityList) (*RpmHeader, *VerificationReport, error) {
+	lead, sigHeader, err := readSignatureHeader(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	// parse the general header, digests are checked below
+	genHeader, err := readHeader(stream, "", 0, sigHeader.isSource, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr := &RpmHeader{
+		lead:      lead,
+		sigHeader: sigHeader,
+		genHeader: genHeader,
+		isSource:  sigHeader.isSource,
+	}
+	b := &reportBuilder{hdr: hdr, knownKeys: knownKeys}
+	if err := b.addSignatures(); err != nil {
+		return nil, nil, err
+	}
+	b.addHeaderDigest(SIG_SHA3_256, crypto.SHA3_256, getSha3_256(sigHeader))
+	b.addHeaderDigest(SIG_SHA256, crypto.SHA256, getSha256(sigHeader))
+	b.addHeaderDigest(SIG_SHA1, crypto.SHA1, getSha1(sigHeader))
+	b.addPayloadDigests()
+	b.addPayloadSize()
+	b.addMD5()
+	if err := b.digestPayload(stream); err != nil {
+		return nil, nil, err
+	}
+	report := new(VerificationReport)
+	for _, check := range b.checks {
+		item := check.item
+		if check.finish != nil {
+			item.Status, item.Reason = check.finish()
+		}
+		report.Items = append(report.Items, item)
+	}
+	return hdr, report, nil
+}
+
+// reportCheck is an item whose status is decided by finish once the RPM has
+// been digested, or is already known if finish is nil
+type reportCheck struct {
+	item   ReportItem
+	finish func() (VerifyStatus, string)
+	// order sorts header items before payload items, and those before
+	// header+payload items
+	order int
+}
+
+const (
+	orderHeader = iota
+	orderPayload
+	orderCombined
+)
+
+type reportBuilder struct {
+	hdr       *RpmHeader
+	knownKeys openpgp.EntityList
+	checks    []reportCheck
+	// payloadWriters receive the compressed payload alone
+	payloadWriters []io.Writer
+	// combinedWriters receive the payload after the general header was
+	// already written to them
+	combinedWriters []io.Writer
+}
+
+func (b *reportBuilder) add(check reportCheck) {
+	// keep items grouped as rpm shows them
+	i := len(b.checks)
+	for i > 0 && b.checks[i-1].order > check.order {
+		i--
+	}
+	b.checks = append(b.checks, reportCheck{})
+	copy(b.checks[i+1:], b.checks[i:])
+	b.checks[i] = check
+}
+
+// addSignatures checks every PGP signature in the same order as Verify
+func (b *reportBuilder) addSignatures() error {
+	var legacyBlobs [][]byte
+	for _, tag := range headerSigTags {
+		if blob, err := b.hdr.sigHeader.GetBytes(tag); err == nil {
+			b.addSignature(tag, blob, true)
+			legacyBlobs = append(legacyBlobs, blob)
+		}
+	}
+	blobs, err := getOpenPGPSignatures(b.hdr.sigHeader)
+	if err != nil {
+		return err
+	}
+nextBlob:
+	for _, blob := range blobs {
+		for _, legacy := range legacyBlobs {
+			if bytes.Equal(blob, legacy) {
+				continue nextBlob
+			}
+		}
+		b.addSignature(SIG_OPENPGP, blob, true)
+	}
+	for _, tag := range payloadSigTags {
+		if blob, err := b.hdr.sigHeader.GetBytes(tag); err == nil {
+			b.addSignature(tag+_SIGHEADER_TAG_BASE, blob, false)
+		}
+	}
+	return nil
+}
+
+func (b *reportBuilder) addSignature(tag int, blob []byte, headerOnly bool) {
+	check := reportCheck{item: ReportItem{Tag: tag}, order: orderHeader}
+	if !headerOnly {
+		check.order = orderCombined
+	}
+	sig, err := parseSignature(blob, b.knownKeys)
+	if err != nil {
+		check.item.Description = signaturePrefix(headerOnly) + "signature"
+		check.item.Status = StatusBad
+		check.item.Reason = err.Error()
+		b.add(check)
+		return
+	}
+	sig.HeaderOnly = headerOnly
+	check.item.Signature = sig
+	check.item.Description = describeReportSignature(sig)
+	h, err := sig.hasher()
+	if err != nil {
+		check.item.Status = StatusUnsupported
+		check.item.Reason = err.Error()
+		b.add(check)
+		return
+	}
+	h.Write(b.hdr.genHeader.orig)
+	if !headerOnly {
+		b.combinedWriters = append(b.combinedWriters, h)
+	}
+	check.finish = func() (VerifyStatus, string) {
+		if b.knownKeys == nil {
+			return StatusNoKey, "no keyring"
+		}
+		err := sig.validate(h)
+		if errors.As(err, &KeyNotFoundError{}) {
+			return StatusNoKey, err.Error()
+		} else if err != nil {
+			return StatusBad, err.Error()
+		}
+		return StatusOK, ""
+	}
+	b.add(check)
+}
+
+func signaturePrefix(headerOnly bool) string {
+	if headerOnly {
+		return "Header "
+	}
+	return ""
+}
+
+// describeReportSignature names a signature as rpm does, e.g. "Header V4
+// RSA/SHA256 Signature, key ID 12345678"
+func describeReportSignature(sig *Signature) string {
+	return fmt.Sprintf("%sV%d %s/%s Signature, key ID %08x",
+		signaturePrefix(sig.HeaderOnly), sig.version, pubKeyAlgoName(sig.PubKeyAlgo), hashName(sig.Hash), uint32(sig.KeyId))
+}
+
+func pubKeyAlgoName(algo packet.PublicKeyAlgorithm) string {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		return "RSA"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case packet.PubKeyAlgoEdDSA:
+		return "EdDSA"
+	case packet.PubKeyAlgoEd25519:
+		return "Ed25519"
+	case packet.PubKeyAlgoEd448:
+		return "Ed448"
+	default:
+		return fmt.Sprintf("algo%d", algo)
+	}
+}
+
+// hashName formats a hash the way rpm does, e.g. SHA256 instead of SHA-256
+func hashName(h crypto.Hash) string {
+	return strings.Replace(h.String(), "SHA-", "SHA", 1)
+}
+
+// addHeaderDigest checks a hex digest of the general header
+func (b *reportBuilder) addHeaderDigest(tag int, hashType crypto.Hash, expected string) {
+	if expected == "" {
+		return
+	}
+	h := hashType.New()
+	h.Write(b.hdr.genHeader.orig)
+	b.add(reportCheck{
+		item: ReportItem{
+			Description: fmt.Sprintf("Header %s digest", hashName(hashType)),
+			Tag:         tag,
+		},
+		finish: compareHexDigest(h, expected),
+		order:  orderHeader,
+	})
+}
+
+// addPayloadDigests checks the digest of the compressed payload.
+// PAYLOADDIGESTALT is reported but not checked, as checking it would mean
+// decompressing the payload.
+func (b *reportBuilder) addPayloadDigests() {
+	for _, tag := range []int{PAYLOADDIGEST, PAYLOADDIGESTALT} {
+		if !b.hdr.genHeader.HasTag(tag) {
+			continue
+		}
+		check := reportCheck{item: ReportItem{Tag: tag}, order: orderPayload}
+		expected, hashType := getPayloadDigestTag(b.hdr.genHeader, tag)
+		name := "Payload"
+		if hashType != 0 {
+			name += " " + hashName(hashType)
+		}
+		if tag == PAYLOADDIGESTALT {
+			name += " ALT"
+		}
+		check.item.Description = name + " digest"
+		switch {
+		case hashType == 0 || !hashType.Available():
+			check.item.Status = StatusUnsupported
+			check.item.Reason = "unsupported payload digest algorithm"
+		case tag == PAYLOADDIGESTALT:
+			check.item.Status = StatusNotChecked
+			check.item.Reason = "the uncompressed payload is not digested"
+		default:
+			h := hashType.New()
+			b.payloadWriters = append(b.payloadWriters, h)
+			check.finish = compareHexDigest(h, expected)
+		}
+		b.add(check)
+	}
+}
+
+// addPayloadSize checks the size of the compressed payload recorded in v6
+// packages
+func (b *reportBuilder) addPayloadSize() {
+	if !b.hdr.genHeader.HasTag(PAYLOADSIZE) {
+		return
+	}
+	size := new(byteCountSink)
+	b.payloadWriters = append(b.payloadWriters, size)
+	b.add(reportCheck{
+		item: ReportItem{Description: "Payload size", Tag: PAYLOADSIZE},
+		finish: func() (VerifyStatus, string) {
+			if err := checkPayloadSize(b.hdr.genHeader, size); err != nil {
+				return StatusBad, err.Error()
+			}
+			return StatusOK, ""
+		},
+		order: orderPayload,
+	})
+}
+
+// addMD5 checks the legacy MD5 digest of the general header and payload
+func (b *reportBuilder) addMD5() {
+	expected, err := b.hdr.sigHeader.GetBytes(SIG_MD5 - _SIGHEADER_TAG_BASE)
+	if err != nil {
+		return
+	}
+	h := md5.New()
+	h.Write(b.hdr.genHeader.orig)
+	b.combinedWriters = append(b.combinedWriters, h)
+	b.add(reportCheck{
+		item: ReportItem{Description: "MD5 digest", Tag: SIG_MD5},
+		finish: func() (VerifyStatus, string) {
+			return compareHexDigest(h, hex.EncodeToString(expected))()
+		},
+		order: orderCombined,
+	})
+}
+
+func compareHexDigest(h hash.Hash, expected string) func() (VerifyStatus, string) {
+	return func() (VerifyStatus, string) {
+		calculated := hex.EncodeToString(h.Sum(nil))
+		if calculated != expected {
+			return StatusBad, fmt.Sprintf("Expected %s != %s", expected, calculated)
+		}
+		return StatusOK, ""
+	}
+}
+
+// digestPayload feeds the payload to every pending check
+func (b *reportBuilder) digestPayload(stream io.Reader) error {
+	writers := make([]io.Writer, 0, len(b.payloadWriters)+len(b.combinedWriters))
+	writers = append(writers, b.payloadWriters...)
+	writers = append(writers, b.combinedWriters...)
+	_, err := io.Copy(io.MultiWriter(writers...), stream)
+	return err
+}
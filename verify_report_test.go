@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReport(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	fp := copyTestRpm(t, "testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	signTestRpm(t, fp, keyring[0].PrivateKey, nil)
+	blob, err := os.ReadFile(fp)
+	require.NoError(t, err)
+
+	_, report, err := VerifyReport(bytes.NewReader(blob), keyring)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	keyID := fmt.Sprintf("%08x", uint32(keyring[0].PrimaryKey.KeyId))
+	var text bytes.Buffer
+	require.NoError(t, report.WriteText(&text, "test.rpm"))
+	assert.Equal(t, "test.rpm:\n"+
+		"    Header V4 RSA/SHA256 Signature, key ID "+keyID+": OK\n"+
+		"    Header SHA256 digest: OK\n"+
+		"    Header SHA1 digest: OK\n"+
+		"    Payload SHA256 digest: OK\n"+
+		"    Payload SHA256 ALT digest: NOTCHECKED\n"+
+		"    V4 RSA/SHA256 Signature, key ID "+keyID+": OK\n"+
+		"    MD5 digest: OK\n", text.String())
+
+	// without keys, only the digests can be checked
+	_, report, err = VerifyReport(bytes.NewReader(blob), nil)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	for _, item := range report.Items {
+		if item.Signature != nil {
+			assert.Equal(t, StatusNoKey, item.Status, item.Description)
+		} else if item.Tag == PAYLOADDIGESTALT {
+			assert.Equal(t, StatusNotChecked, item.Status, item.Description)
+		} else {
+			assert.Equal(t, StatusOK, item.Status, item.Description)
+		}
+	}
+
+	// corrupt the end of the payload and report everything that covers it
+	blob[len(blob)-1] ^= 0xff
+	_, report, err = VerifyReport(bytes.NewReader(blob), keyring)
+	require.NoError(t, err)
+	statuses := make(map[string]VerifyStatus)
+	for _, item := range report.Items {
+		statuses[item.Description] = item.Status
+	}
+	assert.Equal(t, map[string]VerifyStatus{
+		"Header V4 RSA/SHA256 Signature, key ID " + keyID: StatusOK,
+		"Header SHA256 digest":                            StatusOK,
+		"Header SHA1 digest":                              StatusOK,
+		"Payload SHA256 digest":                           StatusBad,
+		"Payload SHA256 ALT digest":                       StatusNotChecked,
+		"V4 RSA/SHA256 Signature, key ID " + keyID:        StatusBad,
+		"MD5 digest":                                      StatusBad,
+	}, statuses)
+	text.Reset()
+	require.NoError(t, report.WriteText(&text, "test.rpm"))
+	assert.Contains(t, text.String(), "    MD5 digest: BAD (Expected ")
+}
+
+func TestVerifyHeaderOnly(t *testing.T) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader([]byte(testkey)))
+	require.NoError(t, err)
+	fp := copyTestRpm(t, "testdata/payload-test-0.1-w9.gzdio.x86_64.rpm")
+	signTestRpm(t, fp, keyring[0].PrivateKey, nil)
+	blob, err := os.ReadFile(fp)
+	require.NoError(t, err)
+
+	r := bytes.NewReader(blob)
+	_, result, err := VerifyHeaderOnly(r, keyring)
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Len())
+	assert.Equal(t, crypto.SHA256, result.HeaderDigest)
+	assert.Equal(t, GuaranteeHeaderDigest|GuaranteeHeaderSignature, result.Checked)
+	assert.Equal(t, GuaranteePayloadDigest|GuaranteePayloadSignature, result.NotChecked)
+	assert.Equal(t, "payload digest, payload signature", result.NotChecked.String())
+	require.Len(t, result.Signatures, 1)
+	assert.Equal(t, keyring[0], result.Signatures[0].Signer)
+	require.Len(t, result.PayloadSignatures, 1)
+	assert.Nil(t, result.PayloadSignatures[0].Signer)
+
+	// without keys, and from a stream that can't seek
+	_, result, err = VerifyHeaderOnly(io.MultiReader(bytes.NewReader(blob)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, GuaranteeHeaderDigest, result.Checked)
+	assert.Equal(t, GuaranteeHeaderSignature|GuaranteePayloadDigest|GuaranteePayloadSignature, result.NotChecked)
+
+	// payload corruption goes unnoticed, but header corruption does not
+	blob[len(blob)-1] ^= 0xff
+	_, _, err = VerifyHeaderOnly(bytes.NewReader(blob), keyring)
+	require.NoError(t, err)
+	hdr, err := ReadHeader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	blob[hdr.OriginalSignatureHeaderSize()+100] ^= 0xff
+	_, _, err = VerifyHeaderOnly(bytes.NewReader(blob), keyring)
+	assert.Error(t, err)
+}
+
+func TestV6Package(t *testing.T) {
+	// synthetic v6 packages: the zstd payload-test and empty packages, with
+	// RPMFORMAT, PAYLOADSIZE, PAYLOADSIZEALT and PAYLOADDIGESTALT added and
+	// the SIZE, MD5, SHA1 and payload size tags removed from the signature
+	// header
+	for _, fp := range []string{"testdata/payload-test-0.1-v6.x86_64.rpm", "testdata/empty-0.1-1.v6.x86_64.rpm"} {
+		t.Run(fp, func(t *testing.T) {
+			blob, err := os.ReadFile(fp)
+			require.NoError(t, err)
+			hdr, err := ReadHeader(bytes.NewReader(blob))
+			require.NoError(t, err)
+			assert.False(t, hdr.HasTag(SIG_MD5))
+			assert.False(t, hdr.HasTag(SIG_SHA1))
+			version, err := hdr.FormatVersion()
+			require.NoError(t, err)
+			assert.Equal(t, 6, version)
+			size, err := hdr.CompressedPayloadSize()
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(blob)-hdr.GetRange().End), size)
+			payloadSize, err := hdr.PayloadSize()
+			require.NoError(t, err)
+			expected, err := hdr.GetUint64(PAYLOADSIZEALT)
+			require.NoError(t, err)
+			assert.Equal(t, int64(expected), payloadSize)
+
+			_, _, err = Verify(bytes.NewReader(blob), nil)
+			require.NoError(t, err)
+			_, report, err := VerifyReport(bytes.NewReader(blob), nil)
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			var descriptions []string
+			for _, item := range report.Items {
+				descriptions = append(descriptions, item.Description)
+			}
+			assert.Equal(t, []string{"Header SHA3-256 digest", "Header SHA256 digest", "Payload SHA256 digest", "Payload SHA256 ALT digest", "Payload size"}, descriptions)
+			alt := report.Items[3]
+			assert.Equal(t, PAYLOADDIGESTALT, alt.Tag)
+			assert.Equal(t, StatusNotChecked, alt.Status)
+			assert.Equal(t, "the uncompressed payload is not digested", alt.Reason)
+
+			// a digest algorithm that isn't supported is reported as such
+			hdr.genHeader.setUint32s(PAYLOADDIGESTALGO, []uint32{1234})
+			b := &reportBuilder{hdr: hdr}
+			b.addPayloadDigests()
+			require.Len(t, b.checks, 2)
+			for _, check := range b.checks {
+				assert.Equal(t, StatusUnsupported, check.item.Status, check.item.Description)
+				assert.Nil(t, check.finish)
+			}
+
+			// an extra byte at the end of the payload
+			_, report, err = VerifyReport(bytes.NewReader(append(blob[:len(blob):len(blob)], 0)), nil)
+			require.NoError(t, err)
+			last := report.Items[len(report.Items)-1]
+			assert.Equal(t, StatusBad, last.Status)
+			assert.Equal(t, fmt.Sprintf("payload size mismatch: expected %d bytes, found %d", size, size+1), last.Reason)
+		})
+	}
+	// older packages are format 4
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+	hdr, err := ReadHeader(f)
+	require.NoError(t, err)
+	version, err := hdr.FormatVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 4, version)
+	// the lead version is not checked, as the format is recorded in RPMFORMAT
+	blob, err := os.ReadFile("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	blob[4] = 2
+	hdr, err = ReadHeader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	version, err = hdr.FormatVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 4, version)
+}
+
+func TestV6PayloadCoveredByAltDigest(t *testing.T) {
+	blob, err := os.ReadFile("testdata/payload-test-0.1-v6.x86_64.rpm")
+	require.NoError(t, err)
+	hdr, err := ReadHeader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	// without PAYLOADDIGEST only the ALT digest covers the payload, which
+	// Verify doesn't decompress
+	delete(hdr.genHeader.entries, PAYLOADDIGEST)
+	_, _, err = digestAndVerify(hdr.sigHeader, hdr.genHeader, bytes.NewReader(blob[hdr.GetRange().End:]), nil)
+	assert.EqualError(t, err, "no usable payload digest found")
+	// but the payload readers check it
+	rpm := &Rpm{Header: hdr, f: bytes.NewReader(blob[hdr.GetRange().End:])}
+	payload, err := rpm.PayloadReaderWithOptions(PayloadOptions{VerifyDigests: true})
+	require.NoError(t, err)
+	for err == nil {
+		_, err = payload.Next()
+	}
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpmutils
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sassoftware/go-rpmutils/cpio"
+	"github.com/sassoftware/go-rpmutils/fileutil"
+)
+
+// FileVerifyResult is the outcome of checking one file of a package against an
+// installed tree
+type FileVerifyResult struct {
+	// Name of the file in the package
+	Name string
+	// Flags holds the file's RPMFILE_* attributes, e.g. RPMFILE_CONFIG
+	Flags int
+	// Result holds a RPMVERIFY_* bit for each attribute that differs, or
+	// RPMVERIFY_LSTATFAIL if the file is missing
+	Result int
+}
+
+// Missing returns true if the file does not exist in the tree
+func (r FileVerifyResult) Missing() bool {
+	return r.Result&RPMVERIFY_LSTATFAIL != 0
+}
+
+// reportable returns true if rpm -V would show the result without -v
+func (r FileVerifyResult) reportable() bool {
+	if r.Missing() {
+		return r.Flags&(RPMFILE_MISSINGOK|RPMFILE_GHOST) == 0
+	}
+	return r.Result != 0
+}
+
+// String formats the result as a line of rpm -V output
+func (r FileVerifyResult) String() string {
+	if r.Missing() {
+		return fmt.Sprintf("missing   %c %s", fileAttrChar(r.Flags), r.Name)
+	}
+	return fmt.Sprintf("%s  %c %s", verifyString(r.Result), fileAttrChar(r.Flags), r.Name)
+}
+
+// verifyString formats the SM5DLUGTP flags, with "." for attributes that match
+// and "?" for those that could not be read
+func verifyString(result int) string {
+	flag := func(bit int, c byte) byte {
+		if result&bit != 0 {
+			return c
+		}
+		return '.'
+	}
+	digest := flag(RPMVERIFY_FILEDIGEST, '5')
+	if result&RPMVERIFY_READFAIL != 0 {
+		digest = '?'
+	}
+	link := flag(RPMVERIFY_LINKTO, 'L')
+	if result&RPMVERIFY_READLINKFAIL != 0 {
+		link = '?'
+	}
+	return string([]byte{
+		flag(RPMVERIFY_FILESIZE, 'S'),
+		flag(RPMVERIFY_MODE, 'M'),
+		digest,
+		flag(RPMVERIFY_RDEV, 'D'),
+		link,
+		flag(RPMVERIFY_USER, 'U'),
+		flag(RPMVERIFY_GROUP, 'G'),
+		flag(RPMVERIFY_MTIME, 'T'),
+		flag(RPMVERIFY_CAPS, 'P'),
+	})
+}
+
+func fileAttrChar(flags int) byte {
+	switch {
+	case flags&RPMFILE_CONFIG != 0:
+		return 'c'
+	case flags&RPMFILE_DOC != 0:
+		return 'd'
+	case flags&RPMFILE_GHOST != 0:
+		return 'g'
+	case flags&RPMFILE_LICENSE != 0:
+		return 'l'
+	case flags&RPMFILE_PUBKEY != 0:
+		return 'P'
+	case flags&RPMFILE_README != 0:
+		return 'r'
+	default:
+		return ' '
+	}
+}
+
+// TreeReport holds the result of checking every file of a package against an
+// installed tree
+type TreeReport struct {
+	Files []FileVerifyResult
+}
+
+// OK returns true if rpm -V would report no problems. Missing %ghost and
+// %missingok files are not problems.
+func (r *TreeReport) OK() bool {
+	for _, file := range r.Files {
+		if file.reportable() {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes the report in the same format as rpm -V. If verbose is set,
+// every file is listed as with rpm -Vv.
+func (r *TreeReport) WriteText(w io.Writer, verbose bool) error {
+	for _, file := range r.Files {
+		if !verbose && !file.reportable() {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, file.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyTree checks every file of a package against a tree it was installed or
+// extracted into, as rpm -V does. Each file is checked for the attributes
+// selected by FILEVERIFYFLAGS, with the content checks skipped for %ghost
+// files.
+//
+// File owners are resolved using the tree's /etc/passwd and /etc/group if it
+// has them, otherwise using the host's user database.
+func VerifyTree(root string, hdr *RpmHeader) (*TreeReport, error) {
+	files, err := hdr.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	hashType, err := fileDigestHash(hdr)
+	if err != nil {
+		return nil, err
+	}
+	verifyFlags, err := hdr.GetUint32s(FILEVERIFYFLAGS)
+	if err != nil || len(verifyFlags) != len(files) {
+		verifyFlags = nil
+	}
+	rdevs, err := hdr.GetUint32s(FILERDEVS)
+	if err != nil || len(rdevs) != len(files) {
+		rdevs = nil
+	}
+	caps, err := hdr.GetStrings(FILECAPS)
+	if err != nil || len(caps) != len(files) {
+		caps = nil
+	}
+	v := &treeVerifier{
+		root:     root,
+		hashType: hashType,
+		ids:      loadIDNames(root),
+	}
+	report := new(TreeReport)
+	for i, info := range files {
+		fi := info.(*fileInfo)
+		check := ^uint32(0)
+		if verifyFlags != nil {
+			check = verifyFlags[i]
+		}
+		want := wantedFile{fileInfo: fi}
+		if rdevs != nil {
+			want.rdev = rdevs[i]
+		}
+		if caps != nil {
+			want.caps = caps[i]
+		}
+		report.Files = append(report.Files, FileVerifyResult{
+			Name:   fi.name,
+			Flags:  fi.Flags(),
+			Result: v.verify(want, int(check)),
+		})
+	}
+	return report, nil
+}
+
+type treeVerifier struct {
+	root     string
+	hashType crypto.Hash
+	ids      *idNames
+}
+
+// wantedFile holds the metadata a file is checked against
+type wantedFile struct {
+	*fileInfo
+	rdev uint32
+	caps string
+}
+
+func (v *treeVerifier) verify(want wantedFile, check int) int {
+	path := filepath.Join(v.root, filepath.FromSlash(want.name))
+	st, err := os.Lstat(path)
+	if err != nil {
+		return RPMVERIFY_LSTATFAIL
+	}
+	mode := unixMode(st.Mode())
+	if want.flags&RPMFILE_GHOST != 0 {
+		// content checks of %ghost files are meaningless
+		check &^= RPMVERIFY_FILEDIGEST | RPMVERIFY_FILESIZE | RPMVERIFY_MTIME | RPMVERIFY_LINKTO
+	}
+	switch mode &^ 07777 {
+	case cpio.S_ISREG:
+		check &^= RPMVERIFY_LINKTO
+	case cpio.S_ISLNK:
+		check &^= RPMVERIFY_FILEDIGEST | RPMVERIFY_FILESIZE | RPMVERIFY_MTIME | RPMVERIFY_MODE | RPMVERIFY_CAPS
+	default:
+		check &^= RPMVERIFY_FILEDIGEST | RPMVERIFY_FILESIZE | RPMVERIFY_MTIME | RPMVERIFY_LINKTO | RPMVERIFY_CAPS
+	}
+	var result int
+	if check&RPMVERIFY_FILEDIGEST != 0 && want.digest != "" {
+		digest, err := v.digestFile(path)
+		if err != nil {
+			result |= RPMVERIFY_READFAIL
+		} else if digest != want.digest {
+			result |= RPMVERIFY_FILEDIGEST
+		}
+	}
+	if check&RPMVERIFY_LINKTO != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			result |= RPMVERIFY_READLINKFAIL
+		} else if target != want.linkName {
+			result |= RPMVERIFY_LINKTO
+		}
+	}
+	if check&RPMVERIFY_FILESIZE != 0 && st.Size() != want.Size() {
+		result |= RPMVERIFY_FILESIZE
+	}
+	if check&RPMVERIFY_MODE != 0 {
+		wantMode, gotMode := want.mode, mode
+		if want.flags&RPMFILE_GHOST != 0 {
+			// the type of a %ghost can't be known, but its permissions can
+			wantMode &= 07777
+			gotMode &= 07777
+		}
+		if wantMode != gotMode {
+			result |= RPMVERIFY_MODE
+		}
+	}
+	if check&RPMVERIFY_RDEV != 0 {
+		wantType, gotType := want.fileType(), mode&^07777
+		if (wantType == cpio.S_ISCHR) != (gotType == cpio.S_ISCHR) || (wantType == cpio.S_ISBLK) != (gotType == cpio.S_ISBLK) {
+			result |= RPMVERIFY_RDEV
+		} else if (wantType == cpio.S_ISCHR || wantType == cpio.S_ISBLK) && fileutil.Rdev(st) != uint64(want.rdev) {
+			result |= RPMVERIFY_RDEV
+		}
+	}
+	if check&RPMVERIFY_MTIME != 0 && st.ModTime().Unix() != int64(want.mtime) {
+		result |= RPMVERIFY_MTIME
+	}
+	if uid, gid, ok := fileutil.Owner(st); ok {
+		if check&RPMVERIFY_USER != 0 && v.ids.user(uid) != want.userName {
+			result |= RPMVERIFY_USER
+		}
+		if check&RPMVERIFY_GROUP != 0 && v.ids.group(gid) != want.groupName {
+			result |= RPMVERIFY_GROUP
+		}
+	}
+	if check&RPMVERIFY_CAPS != 0 && !v.capsMatch(path, want.caps) {
+		result |= RPMVERIFY_CAPS
+	}
+	return result
+}
+
+func (v *treeVerifier) digestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := v.hashType.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (v *treeVerifier) capsMatch(path, wantText string) bool {
+	blob, err := fileutil.GetXattr(path, "security.capability")
+	if err != nil {
+		return false
+	}
+	if wantText == "" || blob == nil {
+		return wantText == "" && blob == nil
+	}
+	want, err := parseCapText(wantText)
+	if err != nil {
+		return false
+	}
+	got, err := parseVfsCaps(blob)
+	if err != nil {
+		return false
+	}
+	return want.equal(got)
+}
+
+// unixMode converts a FileMode to the mode bits stored in FILEMODES
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= cpio.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= cpio.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= cpio.S_ISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= cpio.S_ISDIR
+	case m&os.ModeSymlink != 0:
+		mode |= cpio.S_ISLNK
+	case m&os.ModeNamedPipe != 0:
+		mode |= cpio.S_ISFIFO
+	case m&os.ModeSocket != 0:
+		mode |= cpio.S_ISSOCK
+	case m&os.ModeCharDevice != 0:
+		mode |= cpio.S_ISCHR
+	case m&os.ModeDevice != 0:
+		mode |= cpio.S_ISBLK
+	default:
+		mode |= cpio.S_ISREG
+	}
+	return mode
+}
+
+// idNames resolves numeric user and group IDs to names
+type idNames struct {
+	users, groups map[uint32]string
+}
+
+// loadIDNames reads the user and group databases of a tree. If the tree
+// doesn't have them, the host's are used instead.
+func loadIDNames(root string) *idNames {
+	return &idNames{
+		users:  readIDFile(filepath.Join(root, "etc", "passwd")),
+		groups: readIDFile(filepath.Join(root, "etc", "group")),
+	}
+}
+
+// readIDFile reads the names and IDs from a passwd or group file, or returns
+// nil if it can't be read
+func readIDFile(path string) map[uint32]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	names := make(map[uint32]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if id, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+			if _, ok := names[uint32(id)]; !ok {
+				names[uint32(id)] = fields[0]
+			}
+		}
+	}
+	return names
+}
+
+func (n *idNames) user(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if n.users != nil {
+		if name, ok := n.users[uid]; ok {
+			return name
+		}
+		return id
+	}
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+func (n *idNames) group(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if n.groups != nil {
+		if name, ok := n.groups[gid]; ok {
+			return name
+		}
+		return id
+	}
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
+}
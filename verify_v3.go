@@ -19,6 +19,8 @@ func parseSignatureMaybeV3(genpkt packet.Packet, knownKeys openpgp.EntityList) (
 		Hash:         pkt.Hash,
 		CreationTime: pkt.CreationTime,
 		KeyId:        pkt.IssuerKeyId,
+		PubKeyAlgo:   pkt.PubKeyAlgo,
+		version:      3,
 	}
 	sig.validate = func(h hash.Hash) error {
 		if knownKeys == nil {
@@ -29,7 +31,15 @@ func parseSignatureMaybeV3(genpkt packet.Packet, knownKeys openpgp.EntityList) (
 			return KeyNotFoundError{KeyID: pkt.IssuerKeyId}
 		}
 		setEntity(sig, keys[0].Entity)
-		return keys[0].PublicKey.VerifySignatureV3(h, pkt)
+		if err := keys[0].PublicKey.VerifySignatureV3(h, pkt); err != nil {
+			return err
+		}
+		return checkKeyValidity(keys[0].Entity, keys[0].PublicKey, pkt.CreationTime)
 	}
 	return sig, nil
 }
+
+// parseRawSignatureV3 is not needed, as the fork parses v3 signatures itself
+func parseRawSignatureV3(blob []byte, knownKeys openpgp.EntityList) (*Signature, error) {
+	return nil, nil
+}
@@ -3,12 +3,16 @@ package rpmutils
 import (
 	"bytes"
 	"hash"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
 func parseSignature(blob []byte, knownKeys openpgp.EntityList) (*Signature, error) {
+	if sig, err := parseRawSignatureV3(blob, knownKeys); sig != nil || err != nil {
+		return sig, err
+	}
 	reader := bytes.NewReader(blob)
 	genpkt, err := packet.Read(reader)
 	if err != nil {
@@ -28,17 +32,23 @@ func parseSignatureV4(genpkt packet.Packet, knownKeys openpgp.EntityList) (*Sign
 		Hash:           pkt.Hash,
 		CreationTime:   pkt.CreationTime,
 		KeyFingerprint: pkt.IssuerFingerprint,
+		PubKeyAlgo:     pkt.PubKeyAlgo,
+		version:        pkt.Version,
 	}
 	if pkt.IssuerKeyId != nil {
 		sig.KeyId = *pkt.IssuerKeyId
 	}
+	sig.newHash = pkt.PrepareVerify
 	sig.validate = func(h hash.Hash) error {
 		if knownKeys == nil {
 			return nil
 		}
 		if entity, key := findKey(pkt, knownKeys); key != nil {
 			setEntity(sig, entity)
-			return key.VerifySignature(h, pkt)
+			if err := key.VerifySignature(h, pkt); err != nil {
+				return err
+			}
+			return checkKeyValidity(entity, key, pkt.CreationTime)
 		}
 		return KeyNotFoundError{
 			KeyID:       sig.KeyId,
@@ -76,3 +86,49 @@ func findKey(sig *packet.Signature, knownKeys openpgp.EntityList) (*openpgp.Enti
 	}
 	return nil, nil
 }
+
+// checkKeyValidity returns a KeyValidityError if key, which belongs to entity,
+// could not make signatures at the given time. Only the latest self-signatures
+// are available, so their key lifetime and flags are applied to the past.
+func checkKeyValidity(entity *openpgp.Entity, key *packet.PublicKey, when time.Time) error {
+	keyErr := KeyValidityError{KeyID: key.KeyId, Fingerprint: key.Fingerprint}
+	if key.CreationTime.After(when) || entity.PrimaryKey.CreationTime.After(when) {
+		keyErr.Reason = KeyNotYetValid
+		return keyErr
+	}
+	// revocations made after the signature don't affect it, unless the key
+	// was compromised
+	if entity.Revoked(when) {
+		keyErr.Reason = KeyRevoked
+		return keyErr
+	}
+	selfSig, _ := entity.PrimarySelfSignature()
+	if selfSig != nil && entity.PrimaryKey.KeyExpired(selfSig, when) {
+		keyErr.Reason = KeyExpired
+		return keyErr
+	}
+	if key == entity.PrimaryKey {
+		if selfSig != nil && selfSig.FlagsValid && !selfSig.FlagSign {
+			keyErr.Reason = KeyNotForSigning
+			return keyErr
+		}
+		return nil
+	}
+	for _, sub := range entity.Subkeys {
+		if sub.PublicKey != key {
+			continue
+		}
+		switch {
+		case sub.Revoked(when):
+			keyErr.Reason = KeyRevoked
+		case sub.PublicKey.KeyExpired(sub.Sig, when):
+			keyErr.Reason = KeyExpired
+		case !sub.Sig.FlagsValid || !sub.Sig.FlagSign:
+			keyErr.Reason = KeyNotForSigning
+		default:
+			return nil
+		}
+		return keyErr
+	}
+	return nil
+}
@@ -122,6 +122,46 @@ func (hdr *rpmHeader) WriteTo(outfile io.Writer, regionTag int) error {
 	return nil
 }
 
+// setStrings replaces the value of a tag with a string or string array
+func (hdr *rpmHeader) setStrings(tag int, dataType int32, vals []string) {
+	var buf bytes.Buffer
+	for _, val := range vals {
+		buf.WriteString(val)
+		buf.WriteByte(0)
+	}
+	hdr.entries[tag] = entry{
+		dataType: dataType,
+		count:    int32(len(vals)),
+		contents: buf.Bytes(),
+	}
+}
+
+// setUint32s replaces the value of a tag with an array of 32-bit integers
+func (hdr *rpmHeader) setUint32s(tag int, vals []uint32) {
+	buf := make([]byte, 4*len(vals))
+	for i, val := range vals {
+		binary.BigEndian.PutUint32(buf[4*i:], val)
+	}
+	hdr.entries[tag] = entry{
+		dataType: RPM_INT32_TYPE,
+		count:    int32(len(vals)),
+		contents: buf,
+	}
+}
+
+// setUint64s replaces the value of a tag with an array of 64-bit integers
+func (hdr *rpmHeader) setUint64s(tag int, vals []uint64) {
+	buf := make([]byte, 8*len(vals))
+	for i, val := range vals {
+		binary.BigEndian.PutUint64(buf[8*i:], val)
+	}
+	hdr.entries[tag] = entry{
+		dataType: RPM_INT64_TYPE,
+		count:    int32(len(vals)),
+		contents: buf,
+	}
+}
+
 func (hdr *rpmHeader) size(regionTag int) (uint64, error) {
 	var sink byteCountSink
 	if err := hdr.WriteTo(&sink, regionTag); err != nil {